@@ -0,0 +1,335 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/pkg/errors"
+
+	"github.com/reinho/cdp-screenshots/screenshot"
+)
+
+// Batch renders many targets with shared options and delivers them in
+// a single callback. The job takes one JSON object argument holding the
+// targets along with the fields of Message, which apply to all of them.
+type Batch struct {
+	Message
+	Targets []BatchTarget `json:"targets"`
+}
+
+type BatchTarget struct {
+	Label string `json:"label"` // the index by default
+	HTML  string `json:"html"`  // either HTML or URL, preferred HTML
+	URL   string `json:"url"`
+}
+
+// batchManifest is the aggregated result of a batch. With the s3 callback it
+// is the body of the callback, with blob it's manifest.json of the archive.
+type batchManifest struct {
+	ID        string       `json:"id"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Items     []*batchItem `json:"items"`
+}
+
+type batchItem struct {
+	Label  string             `json:"label"`
+	Target string             `json:"target,omitempty"` // url of the target, empty for html
+	Error  string             `json:"error,omitempty"`
+	File   string             `json:"file,omitempty"` // name of the image in the archive
+	URL    string             `json:"url,omitempty"`  // s3 location of the image
+	URLs   map[string]string  `json:"urls,omitempty"` // s3 location of the artifacts
+	Result *screenshot.Result `json:"result,omitempty"`
+}
+
+// parseBatch decodes the batch of the job arguments. An invalid batch is
+// returned along with the error, so that it can be rejected.
+func parseBatch(args []interface{}) (*Batch, error) {
+	if len(args) != 1 {
+		return nil, errors.New("a batch takes a single argument")
+	}
+
+	encoded, err := json.Marshal(args[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to encode the batch")
+	}
+	batch := &Batch{}
+	if err := json.Unmarshal(encoded, batch); err != nil {
+		return nil, errors.Wrap(err, "unable to decode the batch")
+	}
+
+	if len(batch.Targets) == 0 {
+		return batch, errors.New("the batch has no targets")
+	}
+	if len(batch.Targets) > *batchMaxTargets {
+		return batch, errors.Errorf("the batch has %d targets, more than the limit of %d", len(batch.Targets), *batchMaxTargets)
+	}
+	if err := batch.Validate(); err != nil {
+		return batch, err
+	}
+
+	return batch, nil
+}
+
+func batchWorker(queue string, args ...interface{}) error {
+	batch, err := parseBatch(args)
+	if err != nil {
+		err = errors.Wrap(err, "invalid batch arguments")
+		if batch != nil {
+			return rejectInvalid(&batch.Message, "Batch", queue, err)
+		}
+		return err
+	}
+
+	batchID := batch.JobID
+	if batchID == "" {
+		batchID = uniuri.New()
+	}
+
+	if moved, err := routeJob(queue, batch.Queue, "Batch", args); err != nil || moved {
+		if moved && batch.JobID != "" {
+			newJobStatus(batchID, "Batch", batch.Queue, batch.Tenant).set(JobQueued)
+		}
+		return err
+	}
+	q := findQueue(queue)
+
+	status := newJobStatus(batchID, "Batch", queue, batch.Tenant)
+	if dropCancelled(status, batch.JobID) {
+		return nil
+	}
+
+	renderTimeout, err := batch.RenderTimeout()
+	if err != nil {
+		return status.fail(err)
+	}
+
+	// The targets run batch_concurrency at a time, each within the render
+	// timeout
+	rounds := (len(batch.Targets) + *batchConcurrency - 1) / *batchConcurrency
+	tenant, releaseTenant, err := admitTenant(status, &batch.Message, len(batch.Targets)*batch.Captures(), time.Duration(rounds)*renderTimeout+*callbackTimeout)
+	if err == errTenantBusy {
+		return deferJob(status, batch.JobID, queue, "Batch", args, err)
+	}
+	if err != nil {
+		return err
+	}
+	defer releaseTenant()
+
+	status.set(JobRunning)
+	tenant.record(usageJobs, 1)
+
+	batchCtx, job, finish := startJob(context.Background(), batchID, batch.Tenant)
+	defer finish()
+
+	log.Printf("[%s] Started processing a batch of %d targets", batchID, len(batch.Targets))
+
+	// Fan the targets out, at most batch_concurrency at a time
+	var (
+		items   = make([]*batchItem, len(batch.Targets))
+		sem     = make(chan struct{}, *batchConcurrency)
+		pending sync.WaitGroup
+	)
+	for i, target := range batch.Targets {
+		if batchCtx.Err() != nil {
+			break
+		}
+
+		msg := batch.Message
+		msg.HTML, msg.URL = target.HTML, target.URL
+
+		item := &batchItem{
+			Label:  target.Label,
+			Target: target.URL,
+		}
+		if item.Label == "" {
+			item.Label = strconv.Itoa(i)
+		}
+		if target.HTML != "" {
+			item.Target = ""
+		}
+		items[i] = item
+
+		pending.Add(1)
+		sem <- struct{}{}
+		release := acquireSlots(q)
+		go func(msgID string, msg *Message) {
+			defer pending.Done()
+			defer func() { <-sem }()
+			defer release()
+
+			host, err := waitForHost(batchCtx, msgID, msg, renderTimeout)
+			if err != nil {
+				log.Printf("[%s] Failed to take a screenshot: %+v", msgID, err)
+				item.Error = err.Error()
+				return
+			}
+			defer host.release()
+
+			ctx, cancel := context.WithTimeout(batchCtx, renderTimeout)
+			defer cancel()
+
+			result, err := render(ctx, msgID, msg)
+			if err != nil {
+				log.Printf("[%s] Failed to take a screenshot: %+v", msgID, err)
+				item.Error = err.Error()
+				return
+			}
+			item.Result = result
+		}(fmt.Sprintf("%s-%04d", batchID, i), &msg)
+	}
+	pending.Wait()
+
+	mainCtx, cancel := context.WithTimeout(batchCtx, *callbackTimeout)
+	defer cancel()
+
+	if job.startDelivery() {
+		err = deliverBatch(mainCtx, status, &batch.Message, items)
+	}
+	if job.Cancelled() {
+		log.Printf("[%s] Cancelled the batch", batchID)
+		tenant.record(usageCancelled, 1)
+		status.set(JobCancelled)
+		return nil
+	}
+	if err != nil {
+		tenant.record(usageFailed, 1)
+		return status.fail(err)
+	}
+	for _, item := range items {
+		tenant.recordResult(item.Result)
+	}
+	status.set(JobDone)
+	return nil
+}
+
+// deliverBatch stores the successful items and posts the manifest, failing
+// only the items which couldn't be stored.
+func deliverBatch(mainCtx context.Context, status *jobStatus, msg *Message, items []*batchItem) error {
+	batchID := status.ID
+	if msg.CallbackType == "" {
+		msg.CallbackType = "s3"
+	}
+
+	manifest := &batchManifest{
+		ID:    batchID,
+		Items: items,
+	}
+
+	var (
+		body     []byte
+		bodyType string
+	)
+	switch msg.CallbackType {
+	case "s3":
+		if err := mainCtx.Err(); err != nil {
+			return errors.Wrap(err, "unable to upload the batch")
+		}
+		status.set(JobUploading)
+		for i, item := range items {
+			if item.Result == nil {
+				continue
+			}
+
+			prefix := objectKey(status.Tenant, fmt.Sprintf("%s-%04d", batchID, i))
+			if len(item.Result.Data) > 0 {
+				url, err := upload(prefix+"."+item.Result.Format, imageContentType(item.Result.Format), item.Result.Data, imageMetadata(item.Result))
+				if err != nil {
+					item.Error, item.Result = err.Error(), nil
+					continue
+				}
+				item.URL = url
+			}
+
+			urls, err := uploadArtifacts(prefix, item.Result.Artifacts)
+			if err != nil {
+				item.Error, item.Result = err.Error(), nil
+				continue
+			}
+			item.URLs = urls
+		}
+
+		countBatch(manifest)
+		encodedManifest, err := json.Marshal(manifest)
+		if err != nil {
+			return errors.Wrap(err, "unable to encode the batch manifest")
+		}
+		body, bodyType = encodedManifest, "application/json"
+	case "blob":
+		buf := &bytes.Buffer{}
+		archive := zip.NewWriter(buf)
+		for i, item := range items {
+			if item.Result == nil {
+				continue
+			}
+
+			prefix := fmt.Sprintf("%04d", i)
+			if len(item.Result.Data) > 0 {
+				item.File = prefix + "." + item.Result.Format
+				if err := writeZipFile(archive, item.File, item.Result.Data); err != nil {
+					return err
+				}
+			}
+			for _, artifact := range item.Result.Artifacts {
+				if err := writeZipFile(archive, prefix+"-"+artifact.Name, artifact.Data); err != nil {
+					return err
+				}
+			}
+		}
+
+		countBatch(manifest)
+		encodedManifest, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "unable to encode the batch manifest")
+		}
+		if err := writeZipFile(archive, "manifest.json", encodedManifest); err != nil {
+			return err
+		}
+		if err := archive.Close(); err != nil {
+			return errors.Wrap(err, "unable to finish the batch archive")
+		}
+		body, bodyType = buf.Bytes(), "application/zip"
+	default:
+		return errors.Errorf("invalid callback type %q", msg.CallbackType)
+	}
+
+	status.set(JobDelivering)
+	code, err := postCallback(mainCtx, msg.Callback, body, bodyType, nil)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[%s] Batch callback %s - %s done, %d succeeded, %d failed, code was %d.", batchID, msg.CallbackType, msg.Callback, manifest.Succeeded, manifest.Failed, code)
+
+	return nil
+}
+
+func countBatch(manifest *batchManifest) {
+	manifest.Succeeded, manifest.Failed = 0, 0
+	for _, item := range manifest.Items {
+		if item.Error == "" {
+			manifest.Succeeded++
+		} else {
+			manifest.Failed++
+		}
+	}
+}
+
+func writeZipFile(archive *zip.Writer, name string, data []byte) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to add %s to the archive", name)
+	}
+	if _, err := w.Write(data); err != nil {
+		return errors.Wrapf(err, "unable to write %s to the archive", name)
+	}
+	return nil
+}
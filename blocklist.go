@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/reinho/cdp-screenshots/screenshot"
+)
+
+var (
+	blocklist        = screenshot.DefaultBlocklist
+	blocklistModTime time.Time
+	blocklistMu      sync.RWMutex
+)
+
+func currentBlocklist() []string {
+	blocklistMu.RLock()
+	defer blocklistMu.RUnlock()
+	return blocklist
+}
+
+// reloadBlocklist replaces the bundled blocklist with the contents of path
+// whenever the file has been modified since the last load.
+func reloadBlocklist(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	blocklistMu.RLock()
+	modTime := blocklistModTime
+	blocklistMu.RUnlock()
+	if !info.ModTime().After(modTime) {
+		return nil
+	}
+
+	patterns, err := screenshot.LoadBlocklist(path)
+	if err != nil {
+		return err
+	}
+	if _, err := screenshot.NewBlocklist(patterns); err != nil {
+		return err
+	}
+
+	blocklistMu.Lock()
+	blocklist = patterns
+	blocklistModTime = info.ModTime()
+	blocklistMu.Unlock()
+
+	log.Printf("Loaded %d blocklist patterns from %s", len(patterns), path)
+	return nil
+}
+
+func watchBlocklist(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := reloadBlocklist(path); err != nil {
+			log.Printf("Unable to reload the blocklist: %+v", err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+
+	"github.com/dchest/uniuri"
+	"github.com/pkg/errors"
+
+	"github.com/reinho/cdp-screenshots/screenshot"
+)
+
+// jobMetadata is the body of the s3 callback and the metadata part of the
+// blob callback.
+type jobMetadata struct {
+	ID  string `json:"id"`
+	URL string `json:"url,omitempty"` // s3 location of the image
+	*screenshot.Result
+	URLs map[string]string `json:"urls,omitempty"` // s3 location of every artifact
+}
+
+// jobSummary is sent in the X-Screenshot-Metadata header of the callback,
+// the full metadata would outgrow the header limits of the servers.
+type jobSummary struct {
+	ID       string `json:"id"`
+	Format   string `json:"format"`
+	Captures int    `json:"captures"`
+	URL      string `json:"url,omitempty"`
+}
+
+// jobFailure is the body of the failure callback of a rejected job, also sent
+// in the X-Screenshot-Metadata header.
+type jobFailure struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	Error string `json:"error"`
+}
+
+// rejectJob fails the job without running it and tells the callback why.
+// The reason is returned.
+func rejectJob(status *jobStatus, callback string, reason error) error {
+	status.fail(reason)
+	log.Printf("[%s] Rejected: %v", status.ID, reason)
+
+	body, err := json.Marshal(&jobFailure{
+		ID:    status.ID,
+		State: status.State,
+		Error: reason.Error(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to encode the failure")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *callbackTimeout)
+	defer cancel()
+
+	if _, err := postCallback(ctx, callback, body, "application/json", body); err != nil {
+		log.Printf("[%s] Unable to post the failure callback: %+v", status.ID, err)
+	}
+	return reason
+}
+
+// rejectInvalid rejects a message which failed to validate, when it was
+// decoded far enough to have a callback. An invalid job id is replaced, the
+// status of the job is then only logged. The reason is returned.
+func rejectInvalid(msg *Message, class, queue string, reason error) error {
+	if msg == nil || msg.Callback == "" {
+		return reason
+	}
+
+	id := msg.JobID
+	if id == "" || validateJobID(id) != nil {
+		id = uniuri.New()
+	}
+	return rejectJob(newJobStatus(id, class, queue, msg.Tenant), msg.Callback, reason)
+}
+
+// deliver uploads the result and posts the callback of the message, keeping
+// the status of the job up to date.
+func deliver(mainCtx context.Context, status *jobStatus, msg *Message, result *screenshot.Result) error {
+	msgID := status.ID
+	if msg.CallbackType == "" {
+		msg.CallbackType = "s3"
+	}
+
+	contentType := imageContentType(result.Format)
+
+	metadata := &jobMetadata{
+		ID:     msgID,
+		Result: result,
+	}
+
+	var (
+		body     []byte
+		bodyType string
+	)
+	if msg.CallbackType == "s3" {
+		key := objectKey(status.Tenant, msgID+"."+result.Format)
+		if err := mainCtx.Err(); err != nil {
+			return errors.Wrap(err, "unable to upload the result")
+		}
+		status.set(JobUploading)
+
+		if len(result.Data) > 0 {
+			log.Printf("[%s] Starting upload to S3 at %s", msgID, key)
+
+			url, err := upload(key, contentType, result.Data, imageMetadata(result))
+			if err != nil {
+				return err
+			}
+			metadata.URL = url
+			status.URL = url
+		}
+
+		urls, err := uploadArtifacts(objectKey(status.Tenant, msgID), result.Artifacts)
+		if err != nil {
+			return err
+		}
+		metadata.URLs = urls
+		status.URLs = urls
+
+		body, err = json.Marshal(metadata)
+		if err != nil {
+			return errors.Wrap(err, "unable to encode the result metadata")
+		}
+		bodyType = "application/json"
+	} else if msg.CallbackType == "blob" {
+		// The metadata and the artifacts are sent along with the image as
+		// a multipart form
+		encodedMetadata, err := json.Marshal(metadata)
+		if err != nil {
+			return errors.Wrap(err, "unable to encode the result metadata")
+		}
+		body, bodyType, err = multipartBody(msgID+"."+result.Format, contentType, result, encodedMetadata)
+		if err != nil {
+			return errors.Wrap(err, "unable to prepare the callback body")
+		}
+	} else {
+		return errors.Errorf("invalid callback type %q", msg.CallbackType)
+	}
+
+	summary, err := json.Marshal(&jobSummary{
+		ID:       msgID,
+		Format:   result.Format,
+		Captures: result.Captures,
+		URL:      metadata.URL,
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to encode the result summary")
+	}
+
+	status.set(JobDelivering)
+	code, err := postCallback(mainCtx, msg.Callback, body, bodyType, summary)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[%s] Callback %s - %s done, code was %d.", msgID, msg.CallbackType, msg.Callback, code)
+
+	return nil
+}
+
+// postCallback posts the body to the callback URL and returns the status code
+// of the response.
+func postCallback(mainCtx context.Context, callback string, body []byte, contentType string, metadata []byte) (int, error) {
+	callbackContext, callbackCancel := context.WithTimeout(mainCtx, *callbackTimeout)
+	defer callbackCancel()
+
+	req, err := http.NewRequest("POST", callback, bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to prepare the callback")
+	}
+	req.Header.Set("Content-Type", contentType)
+	if metadata != nil {
+		req.Header.Set("X-Screenshot-Metadata", string(metadata))
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(callbackContext))
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to post the callback")
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+// multipartBody packs the metadata, the image and the artifacts of the
+// result into a multipart form with a file field for each of them, named
+// after their label if they have one.
+func multipartBody(name, contentType string, result *screenshot.Result, metadata []byte) ([]byte, string, error) {
+	buf := &bytes.Buffer{}
+	form := multipart.NewWriter(buf)
+
+	parts := []screenshot.Artifact{{
+		Name:        "metadata.json",
+		Label:       "metadata",
+		ContentType: "application/json",
+		Data:        metadata,
+	}}
+	if len(result.Data) > 0 {
+		parts = append(parts, screenshot.Artifact{
+			Name:        name,
+			Label:       "image",
+			ContentType: contentType,
+			Data:        result.Data,
+		})
+	}
+	parts = append(parts, result.Artifacts...)
+
+	for _, part := range parts {
+		field := part.Label
+		if field == "" {
+			field = part.Name
+		}
+
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, field, part.Name))
+		header.Set("Content-Type", part.ContentType)
+
+		w, err := form.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := w.Write(part.Data); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := form.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), form.FormDataContentType(), nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benmanns/goworker"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// runningJob is a job being processed by this worker, which can be
+// cancelled until its delivery starts.
+type runningJob struct {
+	id     string
+	tenant string
+	cancel context.CancelFunc
+	state  int32 // one of the job* states below, accessed atomically
+}
+
+// States of a running job.
+const (
+	jobRendering int32 = iota
+	jobCancelled
+	jobDelivering
+)
+
+var (
+	runningMu   sync.Mutex
+	runningJobs = map[string]*runningJob{}
+)
+
+// jobCancelKey is the redis key which requests the cancellation of a job of
+// the tenant. Producers may set it directly instead of calling DELETE
+// /jobs/<id>, the value doesn't matter.
+func jobCancelKey(tenant, id string) string {
+	return jobKey(tenant, id) + ":cancel"
+}
+
+// startJob registers the job as running and returns its context, which is
+// cancelled once a cancellation of the job is requested. The returned func
+// unregisters the job, clears its cancellation and releases the context.
+func startJob(parent context.Context, id, tenant string) (context.Context, *runningJob, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	job := &runningJob{
+		id:     id,
+		tenant: tenant,
+		cancel: cancel,
+	}
+
+	key := jobKey(tenant, id)
+	runningMu.Lock()
+	runningJobs[key] = job
+	runningMu.Unlock()
+
+	return ctx, job, func() {
+		runningMu.Lock()
+		if runningJobs[key] == job {
+			delete(runningJobs, key)
+		}
+		runningMu.Unlock()
+		cancel()
+		clearCancel(id, tenant)
+	}
+}
+
+// Cancelled reports whether the job was cancelled on request, as opposed to
+// running out of time.
+func (j *runningJob) Cancelled() bool {
+	return atomic.LoadInt32(&j.state) == jobCancelled
+}
+
+// startDelivery reports whether the job may be delivered, in which case the
+// cancellations are ignored from then on.
+func (j *runningJob) startDelivery() bool {
+	return atomic.CompareAndSwapInt32(&j.state, jobRendering, jobDelivering)
+}
+
+func (j *runningJob) cancelJob() {
+	if atomic.CompareAndSwapInt32(&j.state, jobRendering, jobCancelled) {
+		log.Printf("[%s] Cancelling the job on request", j.id)
+		j.cancel()
+	}
+}
+
+// cancelRequested reports whether the cancellation of the job of the tenant
+// was requested.
+func cancelRequested(id, tenant string) (bool, error) {
+	conn, err := goworker.GetConn()
+	if err != nil {
+		return false, errors.Wrap(err, "unable to get a redis connection")
+	}
+	defer goworker.PutConn(conn)
+
+	cancelled, err := redis.Bool(conn.Do("EXISTS", jobCancelKey(tenant, id)))
+	if err != nil {
+		return false, errors.Wrap(err, "unable to check the cancellation of the job")
+	}
+	return cancelled, nil
+}
+
+// clearCancel removes the cancellation of the job once it's over, so that
+// a job resubmitted with the same ID runs.
+func clearCancel(id, tenant string) {
+	conn, err := goworker.GetConn()
+	if err != nil {
+		log.Printf("[%s] Unable to clear the cancellation: %v", id, err)
+		return
+	}
+	defer goworker.PutConn(conn)
+
+	if _, err := conn.Do("DEL", jobCancelKey(tenant, id)); err != nil {
+		log.Printf("[%s] Unable to clear the cancellation: %v", id, err)
+	}
+}
+
+// requestCancel marks the job of the tenant as cancelled. A queued job is
+// dropped once a worker picks it up, a running one is stopped by the worker
+// running it. It returns a nil status for the jobs without a status, which
+// includes those of other tenants. Jobs being delivered or already finished
+// can't be cancelled, their status is returned with ok set to false.
+func requestCancel(tenant, id string) (status *jobStatus, ok bool, err error) {
+	status, err = loadJobStatus(tenant, id)
+	if status == nil || err != nil {
+		return nil, false, err
+	}
+	switch status.State {
+	case JobUploading, JobDelivering, JobDone, JobFailed, JobCancelled:
+		return status, false, nil
+	}
+
+	conn, err := goworker.GetConn()
+	if err != nil {
+		return nil, false, errors.Wrap(err, "unable to get a redis connection")
+	}
+	_, err = conn.Do("SET", jobCancelKey(status.Tenant, id), 1, "EX", jobStatusTTLSeconds())
+	goworker.PutConn(conn)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "unable to request the cancellation")
+	}
+
+	// Nothing runs the job yet, so the status is updated here. It's counted
+	// once a worker drops the job.
+	if status.State == JobQueued {
+		status.State, status.Updated = JobCancelled, time.Now().UTC()
+		if err := storeJobStatus(status); err != nil {
+			return nil, false, err
+		}
+	}
+
+	log.Printf("[%s] Requested the cancellation of the job", id)
+
+	return status, true, nil
+}
+
+// watchCancellations cancels the running jobs whose cancellation was
+// requested, checking every interval.
+func watchCancellations(interval time.Duration) {
+	for range time.Tick(interval) {
+		runningMu.Lock()
+		jobs := make([]*runningJob, 0, len(runningJobs))
+		keys := make([]interface{}, 0, len(runningJobs))
+		for _, job := range runningJobs {
+			jobs = append(jobs, job)
+			keys = append(keys, jobCancelKey(job.tenant, job.id))
+		}
+		runningMu.Unlock()
+
+		if len(jobs) == 0 {
+			continue
+		}
+
+		requested, err := fetchCancellations(keys)
+		if err != nil {
+			log.Printf("Unable to check for cancelled jobs: %+v", err)
+			continue
+		}
+		for i, job := range jobs {
+			if requested[i] {
+				job.cancelJob()
+			}
+		}
+	}
+}
+
+// fetchCancellations returns which of the cancel keys exist by their index.
+func fetchCancellations(keys []interface{}) (map[int]bool, error) {
+	conn, err := goworker.GetConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get a redis connection")
+	}
+	defer goworker.PutConn(conn)
+
+	values, err := redis.Values(conn.Do("MGET", keys...))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read the cancellations")
+	}
+
+	requested := map[int]bool{}
+	for i, value := range values {
+		requested[i] = value != nil
+	}
+	return requested, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/pkg/errors"
+
+	"github.com/reinho/cdp-screenshots/screenshot"
+)
+
+var (
+	configFile  = flag.String("config", "", "INI file with the settings, overridden by the environment and the flags, also read from "+envPrefix+"CONFIG")
+	printConfig = flag.Bool("print-config", false, "print the effective settings with the secrets redacted and exit")
+)
+
+// envPrefix prefixes the environment variables of the settings, eg.
+// SCREENSHOTS_S3_SECRET sets s3_secret.
+const envPrefix = "SCREENSHOTS_"
+
+// Sources of a setting, in the order of precedence.
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// secretSettings are redacted by --print-config and may be read from a file
+// named by the setting with the _file suffix, eg. s3_secret_file.
+var secretSettings = map[string]bool{
+	"redis_uri": true,
+	"s3_key_id": true,
+	"s3_secret": true,
+}
+
+// ignoredFlags are registered by goworker, its settings are configured by
+// redis_uri, redis_connections, redis_namespace, poll_interval and
+// chrome_capacity instead.
+var ignoredFlags = map[string]bool{
+	"queues":           true,
+	"interval":         true,
+	"concurrency":      true,
+	"connections":      true,
+	"uri":              true,
+	"namespace":        true,
+	"exit-on-complete": true,
+	"use-number":       true,
+}
+
+// configSources records where each setting came from.
+var configSources = map[string]string{}
+
+// isSetting reports whether the flag is a setting of the config file and
+// the environment.
+func isSetting(name string) bool {
+	return !ignoredFlags[name] && name != "config" && name != "print-config"
+}
+
+// loadConfig layers the config file at the path and the environment
+// variables under the flags given on the command line. Call it after the
+// flags are parsed.
+func loadConfig(fs *flag.FlagSet, path string) error {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	fs.VisitAll(func(f *flag.Flag) {
+		if isSetting(f.Name) {
+			configSources[f.Name] = sourceDefault
+		}
+	})
+
+	set := func(name, value, source string) error {
+		if explicit[name] {
+			return nil
+		}
+		if err := fs.Set(name, value); err != nil {
+			return errors.Wrapf(err, "invalid %s from the %s", name, source)
+		}
+		configSources[name] = source
+		return nil
+	}
+
+	if path == "" {
+		path = os.Getenv(envPrefix + "CONFIG")
+	}
+	if path != "" {
+		values, err := readConfigFile(fs, path)
+		if err != nil {
+			return err
+		}
+		for name, value := range values {
+			if err := set(name, value, sourceFile); err != nil {
+				return err
+			}
+		}
+	}
+
+	values, err := readEnv(fs)
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		if err := set(name, value, sourceEnv); err != nil {
+			return err
+		}
+	}
+
+	for name := range explicit {
+		if isSetting(name) {
+			configSources[name] = sourceFlag
+		}
+	}
+	return nil
+}
+
+// readConfigFile returns the settings of the INI file. Keys of a section are
+// prefixed by its name, so s3_secret may also be given as secret in [s3].
+func readConfigFile(fs *flag.FlagSet, path string) (map[string]string, error) {
+	file, err := ini.Load(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read the config file %s", path)
+	}
+
+	values := map[string]string{}
+	for _, section := range file.Sections() {
+		for _, key := range section.Keys() {
+			name := key.Name()
+			if section.Name() != ini.DEFAULT_SECTION {
+				name = section.Name() + "_" + name
+			}
+			if err := addSetting(fs, values, name, key.Value(), "config file"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return values, nil
+}
+
+// readEnv returns the settings of the environment variables. Unknown
+// variables with the prefix are only logged, the environment is shared with
+// other programs.
+func readEnv(fs *flag.FlagSet) (map[string]string, error) {
+	values := map[string]string{}
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if !strings.HasPrefix(parts[0], envPrefix) || parts[0] == envPrefix+"CONFIG" {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(parts[0], envPrefix))
+		if !knownSetting(fs, name) {
+			log.Printf("Ignoring %s, %s is not a setting", parts[0], name)
+			continue
+		}
+		if err := addSetting(fs, values, name, parts[1], "environment"); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// knownSetting reports whether the name is a setting or a secret setting
+// given as a file.
+func knownSetting(fs *flag.FlagSet, name string) bool {
+	if secret := strings.TrimSuffix(name, "_file"); secret != name && secretSettings[secret] {
+		return true
+	}
+	return isSetting(name) && fs.Lookup(name) != nil
+}
+
+// addSetting adds the named setting to values, reading the secrets given as
+// files.
+func addSetting(fs *flag.FlagSet, values map[string]string, name, value, source string) error {
+	if !knownSetting(fs, name) {
+		return errors.Errorf("unknown setting %s in the %s", name, source)
+	}
+	if secret := strings.TrimSuffix(name, "_file"); secret != name && secretSettings[secret] {
+		data, err := ioutil.ReadFile(value)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read %s from the %s", secret, source)
+		}
+		name, value = secret, strings.TrimSpace(string(data))
+	}
+
+	if _, ok := values[name]; ok {
+		return errors.Errorf("%s is set more than once in the %s", name, source)
+	}
+	values[name] = value
+	return nil
+}
+
+// validateConfig checks the settings before anything starts, reporting all
+// the problems at once.
+func validateConfig() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	for name, value := range map[string]int{
+		"chrome_capacity":          *chromeCapacity,
+		"screenshots_per_instance": *screenshotsPerInstance,
+		"redis_connections":        *redisConnections,
+		"batch_concurrency":        *batchConcurrency,
+		"batch_max_targets":        *batchMaxTargets,
+		"animation_max_frames":     *animationMaxFrames,
+		"animation_max_size":       *animationMaxSize,
+		"console_max_entries":      *consoleMaxEntries,
+		"console_max_length":       *consoleMaxLength,
+	} {
+		check(value > 0, "%s has to be greater than 0", name)
+	}
+	for name, value := range map[string]int{
+		"host_max_concurrent": *hostMaxConcurrent,
+		"host_max_rate":       *hostMaxRate,
+	} {
+		check(value >= 0, "%s can't be negative", name)
+	}
+	for name, value := range map[string]time.Duration{
+		"poll_interval":          *pollInterval,
+		"html_ttl":               *htmlTTL,
+		"screenshot_timeout":     *screenshotTimeout,
+		"callback_timeout":       *callbackTimeout,
+		"job_status_ttl":         *jobStatusTTL,
+		"cancel_check_interval":  *cancelCheckInterval,
+		"lazy_load_max_duration": *lazyLoadMaxDuration,
+		"animation_max_duration": *animationMaxDuration,
+		"blocklist_refresh":      *blocklistRefresh,
+	} {
+		check(value > 0, "%s has to be greater than 0", name)
+	}
+	check(*chromeStartDelay >= 0, "chrome_start_delay can't be negative")
+
+	switch *htmlMode {
+	case "http", screenshot.HTMLModeDocument, screenshot.HTMLModeData:
+	default:
+		check(false, "invalid html_mode %s", *htmlMode)
+	}
+
+	if u, err := url.Parse(*redisURI); err != nil || (u.Scheme != "redis" && u.Scheme != "unix") {
+		check(false, "redis_uri has to be a redis:// or unix:// url")
+	}
+	check(*redisNamespace != "", "redis_namespace can't be empty")
+	check(*s3Endpoint != "" && *s3Bucket != "", "s3_endpoint and s3_bucket are required")
+
+	if *chromeCapacity > 0 {
+		if _, err := parseQueues(*queues, *chromeCapacity); err != nil {
+			check(false, "invalid job_queues: %v", err)
+		}
+	}
+	if _, err := parseHostLimits(*hostLimits); err != nil {
+		check(false, "invalid host_limits: %v", err)
+	}
+	if _, err := parseCIDRs(*httpAllowedRemotes); err != nil {
+		check(false, "invalid http_allowed_remotes: %v", err)
+	}
+	if _, err := parseCIDRs(*apiAllowedRemotes); err != nil {
+		check(false, "invalid api_allowed_remotes: %v", err)
+	}
+	check(*apiBind != *httpBind, "api_bind and http_bind have to differ")
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.Errorf("invalid configuration:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// dumpConfig formats the effective settings as a config file, noting where
+// each of them came from.
+func dumpConfig() string {
+	buf := &bytes.Buffer{}
+	flag.VisitAll(func(f *flag.Flag) {
+		if !isSetting(f.Name) {
+			return
+		}
+		fmt.Fprintf(buf, "; %s, from the %s\n", f.Usage, configSources[f.Name])
+		fmt.Fprintf(buf, "%s = %s\n\n", f.Name, redactSetting(f.Name, f.Value.String()))
+	})
+	return buf.String()
+}
+
+func redactSetting(name, value string) string {
+	if !secretSettings[name] || value == "" {
+		return value
+	}
+
+	// Only the password of the redis uri is secret
+	if u, err := url.Parse(value); name == "redis_uri" && err == nil {
+		if u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "REDACTED")
+			}
+		}
+		return u.String()
+	}
+	return "REDACTED"
+}
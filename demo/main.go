@@ -2,11 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
-	"sync"
+	"strings"
+	"time"
 
 	"github.com/dchest/uniuri"
 	"github.com/go-redis/redis"
@@ -17,19 +21,30 @@ var (
 	callbackBase = flag.String("callback_base", "http://192.168.1.25:7000/callback", "url of the endpoint callback")
 	redisAddr    = flag.String("redis_addr", "redis:6379", "redis address")
 	redisKey     = flag.String("redis_key", "resque:queue:screenshots", "key for the queue")
+	statusPrefix = flag.String("status_prefix", "resque:job:", "prefix of the job status keys, the redis namespace of the worker followed by job:")
 	indexFile    = flag.String("index_file", "./index.html", "path of the index file")
+	jobsURL      = flag.String("jobs_url", "http://worker:8002/jobs/", "job status endpoint of the worker, which has to allow the demo in api_allowed_remotes, see worker.ini")
+	pollInterval = flag.Duration("poll_interval", 250*time.Millisecond, "how often to poll the status of a job")
+	pollTimeout  = flag.Duration("poll_timeout", time.Minute, "how long to wait for a job to finish")
 )
 
-type result struct {
-	ContentType string
-	Response    []byte
-	Error       error
+// jobStatus is the part of the worker's /jobs/<id> response the demo uses.
+type jobStatus struct {
+	State string `json:"state"`
+	Error string `json:"error"`
+	URL   string `json:"url"`
 }
 
-var (
-	callbacks   = map[string]chan result{}
-	callbacksMu sync.RWMutex
-)
+// queuedStatus is the status the demo stores along with the job, until a
+// worker picks it up.
+type queuedStatus struct {
+	ID      string    `json:"id"`
+	Class   string    `json:"class"`
+	Queue   string    `json:"queue"`
+	State   string    `json:"state"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
 
 type message struct {
 	Class string        `json:"class"`
@@ -63,39 +78,11 @@ func main() {
 		Addr: *redisAddr,
 	})
 
+	// The results are picked up from s3 once the job status says they're
+	// there, the callback only has to succeed
 	http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
-
-		callbacksMu.RLock()
-		resultChan, ok := callbacks[key]
-		callbacksMu.RUnlock()
-
-		if !ok {
-			http.Error(w, "Key not found", http.StatusNotFound)
-			return
-		}
-
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			resultChan <- result{
-				ContentType: r.Header.Get("Content-Type"),
-				Response:    nil,
-				Error:       err,
-			}
-			return
-		}
-
-		resultChan <- result{
-			ContentType: r.Header.Get("Content-Type"),
-			Response:    body,
-			Error:       nil,
-		}
-
+		io.Copy(ioutil.Discard, r.Body)
 		w.Write([]byte("OK"))
-
-		callbacksMu.Lock()
-		delete(callbacks, key)
-		callbacksMu.Unlock()
 	})
 
 	http.HandleFunc("/screenshot", func(w http.ResponseWriter, r *http.Request) {
@@ -106,12 +93,6 @@ func main() {
 		}
 
 		key := uniuri.New()
-		callback := *callbackBase + "?key=" + key
-		resultChan := make(chan result)
-
-		callbacksMu.Lock()
-		callbacks[key] = resultChan
-		callbacksMu.Unlock()
 
 		queueMsg, err := json.Marshal(&message{
 			Class: "Screenshot",
@@ -125,29 +106,62 @@ func main() {
 				inputMsg.FullPage,
 				inputMsg.Format,
 				inputMsg.Quality,
-				callback,
-				inputMsg.CallbackType,
+				*callbackBase,
+				"s3",
+				map[string]interface{}{
+					"job_id": key,
+				},
 			},
 		})
 		if err != nil {
 			panic(err)
 		}
 
-		if err := client.RPush(*redisKey, string(queueMsg)).Err(); err != nil {
+		now := time.Now().UTC()
+		queued, err := json.Marshal(&queuedStatus{
+			ID:      key,
+			Class:   "Screenshot",
+			Queue:   (*redisKey)[strings.LastIndex(*redisKey, ":")+1:],
+			State:   "queued",
+			Created: now,
+			Updated: now,
+		})
+		if err != nil {
 			panic(err)
 		}
 
-		// wait for the callback here
-		result := <-resultChan
+		// The status is there before the job, so /jobs/<id> never misses it
+		pipe := client.TxPipeline()
+		pipe.Set(*statusPrefix+key, string(queued), 2**pollTimeout)
+		pipe.RPush(*redisKey, string(queueMsg))
+		if _, err := pipe.Exec(); err != nil {
+			panic(err)
+		}
 
-		if result.Error != nil {
-			http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		status, err := waitForJob(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		w.Header().Set("Content-Type", result.ContentType)
-		w.Header().Set("Content-Length", strconv.Itoa(len(result.Response)))
-		w.Write(result.Response)
+		if inputMsg.CallbackType == "s3" {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(status.URL))
+			return
+		}
+
+		image, err := http.Get(status.URL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer image.Body.Close()
+
+		w.Header().Set("Content-Type", image.Header.Get("Content-Type"))
+		if image.ContentLength >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(image.ContentLength, 10))
+		}
+		io.Copy(w, image.Body)
 	})
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -160,3 +174,41 @@ func main() {
 
 	http.ListenAndServe(*bind, nil)
 }
+
+// waitForJob polls the status of the job until it's done, failed or
+// cancelled.
+func waitForJob(key string) (*jobStatus, error) {
+	deadline := time.Now().Add(*pollTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(*pollInterval)
+
+		resp, err := http.Get(*jobsURL + key)
+		if err != nil {
+			return nil, err
+		}
+		status := &jobStatus{}
+		err = json.NewDecoder(resp.Body).Decode(status)
+		resp.Body.Close()
+
+		// Expired or not stored yet, still queued as far as the demo knows
+		if resp.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("job status returned %s", resp.Status)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch status.State {
+		case "done":
+			return status, nil
+		case "failed":
+			return nil, errors.New(status.Error)
+		case "cancelled":
+			return nil, errors.New("the screenshot was cancelled")
+		}
+	}
+	return nil, errors.New("timed out waiting for the screenshot")
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benmanns/goworker"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// hostLimit caps the navigations to a host. Zero limits are unlimited. Only
+// the url of a job is limited, not the subresources or the other requests of
+// the page, which may go to the same host.
+type hostLimit struct {
+	Host          string // exact host or a *.example.com wildcard
+	MaxConcurrent int    // navigations at once
+	RatePerSecond int    // navigations started per second
+}
+
+// hostOverrides are the per host limits, the first match applies.
+var hostOverrides []*hostLimit
+
+// errHostBusy defers a job whose host is at its limit.
+var errHostBusy = errors.New("the host is at its concurrency or rate limit")
+
+// parseHostLimits parses the host_limits flag, a comma separated list of
+// host=concurrent:rate entries, eg. "example.com=2:1,*.example.org=8:0".
+func parseHostLimits(value string) ([]*hostLimit, error) {
+	var limits []*hostLimit
+	for _, entry := range splitList(value) {
+		parts := strings.SplitN(entry, "=", 2)
+		host := strings.ToLower(strings.TrimSpace(parts[0]))
+		if host == "" || len(parts) != 2 {
+			return nil, errors.Errorf("invalid host limit %q, expected host=concurrent:rate", entry)
+		}
+
+		values := strings.SplitN(parts[1], ":", 2)
+		if len(values) != 2 {
+			return nil, errors.Errorf("invalid host limit %q, expected host=concurrent:rate", entry)
+		}
+		concurrent, err := strconv.Atoi(strings.TrimSpace(values[0]))
+		if err != nil || concurrent < 0 {
+			return nil, errors.Errorf("invalid concurrency of the host %s: %s", host, values[0])
+		}
+		rate, err := strconv.Atoi(strings.TrimSpace(values[1]))
+		if err != nil || rate < 0 {
+			return nil, errors.Errorf("invalid rate of the host %s: %s", host, values[1])
+		}
+
+		limits = append(limits, &hostLimit{
+			Host:          host,
+			MaxConcurrent: concurrent,
+			RatePerSecond: rate,
+		})
+	}
+	return limits, nil
+}
+
+// limitFor returns the limit of the host, the defaults unless overridden.
+func limitFor(host string) *hostLimit {
+	for _, limit := range hostOverrides {
+		if limit.Host == host {
+			return limit
+		}
+	}
+	for _, limit := range hostOverrides {
+		if strings.HasPrefix(limit.Host, "*.") && strings.HasSuffix(host, limit.Host[1:]) {
+			return limit
+		}
+	}
+	return &hostLimit{
+		Host:          host,
+		MaxConcurrent: *hostMaxConcurrent,
+		RatePerSecond: *hostMaxRate,
+	}
+}
+
+// targetHost returns the host the message navigates to, empty for html.
+func targetHost(msg *Message) string {
+	if msg.HTML != "" || msg.URL == "" {
+		return ""
+	}
+	u, err := url.Parse(msg.URL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// hostScript takes a navigation slot of a host unless it's at its limits.
+//
+// KEYS: running navigations set, rate counter
+// ARGV: now, deadline of the navigation, job id, concurrency and rate limits
+var hostScript = redis.NewScript(2, `
+if tonumber(ARGV[5]) > 0 and tonumber(redis.call('GET', KEYS[2]) or '0') >= tonumber(ARGV[5]) then
+	return 'rate'
+end
+if tonumber(ARGV[4]) > 0 then
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+	if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[4]) then
+		return 'concurrency'
+	end
+	redis.call('ZADD', KEYS[1], ARGV[2], ARGV[3])
+	redis.call('EXPIRE', KEYS[1], 86400)
+end
+if tonumber(ARGV[5]) > 0 then
+	redis.call('INCR', KEYS[2])
+	redis.call('EXPIRE', KEYS[2], 2)
+end
+return 'ok'
+`)
+
+// hostSlot is a navigation slot of a host taken by admitHost.
+type hostSlot struct {
+	jobID   string
+	host    string
+	running string // running navigations set, when the concurrency is limited
+	rate    string // rate counter, when the rate is limited
+}
+
+// admitHost takes a navigation slot of the host of the message for at most
+// the timeout. It returns errHostBusy when the host is at its limits. Release
+// the slot once the navigation is over.
+func admitHost(jobID string, msg *Message, timeout time.Duration) (*hostSlot, error) {
+	slot := &hostSlot{jobID: jobID, host: targetHost(msg)}
+	if slot.host == "" {
+		return slot, nil
+	}
+	limit := limitFor(slot.host)
+	if limit.MaxConcurrent == 0 && limit.RatePerSecond == 0 {
+		return slot, nil
+	}
+
+	conn, err := goworker.GetConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get a redis connection")
+	}
+	defer goworker.PutConn(conn)
+
+	now := time.Now()
+	running := *redisNamespace + "host:" + slot.host + ":running"
+	rate := *redisNamespace + "host:" + slot.host + ":rate:" + strconv.FormatInt(now.Unix(), 10)
+	verdict, err := redis.String(hostScript.Do(conn.Conn,
+		running,
+		rate,
+		now.Unix(),
+		now.Add(timeout).Unix()+1,
+		jobID,
+		limit.MaxConcurrent,
+		limit.RatePerSecond,
+	))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to check the limits of the host")
+	}
+	if verdict != "ok" {
+		return nil, errHostBusy
+	}
+
+	if limit.MaxConcurrent > 0 {
+		slot.running = running
+	}
+	if limit.RatePerSecond > 0 {
+		slot.rate = rate
+	}
+	return slot, nil
+}
+
+// release frees the slot once the navigation is over.
+func (s *hostSlot) release() {
+	if s.running == "" {
+		return
+	}
+	conn, err := goworker.GetConn()
+	if err != nil {
+		log.Printf("[%s] Unable to release the slot of the host %s: %v", s.jobID, s.host, err)
+		return
+	}
+	defer goworker.PutConn(conn)
+	if _, err := conn.Do("ZREM", s.running, s.jobID); err != nil {
+		log.Printf("[%s] Unable to release the slot of the host %s: %v", s.jobID, s.host, err)
+	}
+}
+
+// refund frees the slot of a job deferred before its navigation, giving back
+// the navigation it took from the rate as well.
+func (s *hostSlot) refund() {
+	s.release()
+	if s.rate == "" {
+		return
+	}
+	conn, err := goworker.GetConn()
+	if err != nil {
+		log.Printf("[%s] Unable to refund the rate of the host %s: %v", s.jobID, s.host, err)
+		return
+	}
+	defer goworker.PutConn(conn)
+	if _, err := conn.Do("DECR", s.rate); err != nil {
+		log.Printf("[%s] Unable to refund the rate of the host %s: %v", s.jobID, s.host, err)
+	}
+}
+
+// waitForHost takes a navigation slot of the host of the message, waiting
+// for one as long as the context allows.
+func waitForHost(ctx context.Context, jobID string, msg *Message, timeout time.Duration) (*hostSlot, error) {
+	for {
+		slot, err := admitHost(jobID, msg, timeout)
+		if err != errHostBusy {
+			return slot, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "unable to wait for the host")
+		case <-time.After(requeueDelay):
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHostLimits(t *testing.T) {
+	tests := []struct {
+		value  string
+		limits []*hostLimit
+		err    string
+	}{
+		{"", nil, ""},
+		{"example.com=2:1", []*hostLimit{{"example.com", 2, 1}}, ""},
+		{
+			" Example.COM = 2 : 1 , *.example.org=8:0",
+			[]*hostLimit{{"example.com", 2, 1}, {"*.example.org", 8, 0}},
+			"",
+		},
+		{"example.com=0:0", []*hostLimit{{"example.com", 0, 0}}, ""},
+		{"example.com", nil, "expected host=concurrent:rate"},
+		{"=2:1", nil, "expected host=concurrent:rate"},
+		{"example.com=2", nil, "expected host=concurrent:rate"},
+		{"example.com=x:1", nil, "invalid concurrency of the host example.com"},
+		{"example.com=-1:1", nil, "invalid concurrency of the host example.com"},
+		{"example.com=2:x", nil, "invalid rate of the host example.com"},
+		{"example.com=2:-1", nil, "invalid rate of the host example.com"},
+	}
+	for _, test := range tests {
+		limits, err := parseHostLimits(test.value)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("parseHostLimits(%q) = %v, expected an error containing %q", test.value, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseHostLimits(%q) = %v", test.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(limits, test.limits) {
+			t.Errorf("parseHostLimits(%q) = %+v, expected %+v", test.value, limits, test.limits)
+		}
+	}
+}
+
+func TestLimitFor(t *testing.T) {
+	overrides, err := parseHostLimits("*.example.com=8:0,www.example.com=2:1,*.cdn.example.com=1:0,example.org=3:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved []*hostLimit) { hostOverrides = saved }(hostOverrides)
+	hostOverrides = overrides
+
+	tests := []struct {
+		host  string
+		limit hostLimit
+	}{
+		// an exact host wins over a wildcard listed before it
+		{"www.example.com", hostLimit{"www.example.com", 2, 1}},
+		{"api.example.com", hostLimit{"*.example.com", 8, 0}},
+		// the first matching wildcard wins
+		{"img.cdn.example.com", hostLimit{"*.example.com", 8, 0}},
+		// a wildcard doesn't match the domain itself
+		{"example.com", hostLimit{"example.com", *hostMaxConcurrent, *hostMaxRate}},
+		{"example.org", hostLimit{"example.org", 3, 3}},
+		{"www.example.org", hostLimit{"www.example.org", *hostMaxConcurrent, *hostMaxRate}},
+		{"notexample.com", hostLimit{"notexample.com", *hostMaxConcurrent, *hostMaxRate}},
+	}
+	for _, test := range tests {
+		if limit := limitFor(test.host); *limit != test.limit {
+			t.Errorf("limitFor(%q) = %+v, expected %+v", test.host, *limit, test.limit)
+		}
+	}
+}
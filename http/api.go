@@ -0,0 +1,145 @@
+package http
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// API serves the job status, the cancellations, the usage of the tenants and
+// the metrics. It listens apart from the HTML server, whose bundles are
+// untrusted pages which must not reach it.
+type API struct {
+	// AllowedRemotes restricts which clients may call the API, nil allows
+	// everyone.
+	AllowedRemotes []*net.IPNet
+	// Tenant resolves the API key of a request to /jobs or /usage, sent in
+	// the X-API-Key header or as a bearer token, to its tenant. The API
+	// keys aren't required when Tenant is nil.
+	Tenant func(apiKey string) (tenant string, ok bool)
+	// Jobs looks up the status of a job of the tenant served at /jobs/<id>,
+	// nil if the job is unknown. The route is disabled when Jobs is nil.
+	Jobs func(tenant, id string) (interface{}, error)
+	// Cancel cancels the job of the tenant on DELETE /jobs/<id> and returns
+	// its status, nil if the job is unknown. ok is false when the job can't
+	// be cancelled anymore.
+	Cancel func(tenant, id string) (status interface{}, ok bool, err error)
+	// Usage returns the usage of the tenant on the date, YYYY-MM-DD or empty
+	// for today, served at /usage.
+	Usage func(tenant, date string) (interface{}, error)
+	// Metrics is served at /metrics when set.
+	Metrics http.Handler
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowedRemote(a.AllowedRemotes, r.RemoteAddr) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	switch {
+	case parts[0] == "metrics" && a.Metrics != nil:
+		a.Metrics.ServeHTTP(w, r)
+	case parts[0] == "jobs" && a.Jobs != nil:
+		tenant, ok := a.authenticate(w, r)
+		if !ok {
+			return
+		}
+		var id string
+		if len(parts) == 2 {
+			id = strings.TrimSuffix(parts[1], "/")
+		}
+		a.serveJob(w, r, tenant, id)
+	case parts[0] == "usage" && a.Usage != nil && a.Tenant != nil:
+		tenant, ok := a.authenticate(w, r)
+		if !ok {
+			return
+		}
+		usage, err := a.Usage(tenant, r.URL.Query().Get("date"))
+		if err != nil {
+			log.Printf("Unable to get the usage of %s: %+v", tenant, err)
+			http.Error(w, "unable to get the usage", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, usage)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// authenticate returns the tenant of the API key of the request, responding
+// with an error if it's missing or unknown.
+func (a *API) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if a.Tenant == nil {
+		return "", true
+	}
+
+	key := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); key == "" && strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key == "" {
+		http.Error(w, "api key missing", http.StatusUnauthorized)
+		return "", false
+	}
+
+	tenant, ok := a.Tenant(key)
+	if !ok {
+		http.Error(w, "invalid api key", http.StatusUnauthorized)
+		return "", false
+	}
+	return tenant, true
+}
+
+func (a *API) serveJob(w http.ResponseWriter, r *http.Request, tenant, id string) {
+	if id == "" {
+		http.Error(w, "job id missing", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		status interface{}
+		code   = http.StatusOK
+		err    error
+	)
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		status, err = a.Jobs(tenant, id)
+	case r.Method == http.MethodDelete && a.Cancel != nil:
+		var ok bool
+		status, ok, err = a.Cancel(tenant, id)
+		code = http.StatusAccepted
+		if !ok {
+			code = http.StatusConflict
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to %s the job %s: %+v", strings.ToLower(r.Method), id, err)
+		http.Error(w, "unable to process the job", http.StatusInternalServerError)
+		return
+	}
+	if status == nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, code, status)
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, "unable to encode the response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(encoded)
+}
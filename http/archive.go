@@ -0,0 +1,107 @@
+package http
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MaxArchiveSize is the limit of the total uncompressed size of an archive.
+const MaxArchiveSize = 64 << 20
+
+// ReadArchive extracts the files of a zip, tar or gzipped tar archive.
+func ReadArchive(data []byte) (map[string][]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return readZip(data)
+	case bytes.HasPrefix(data, []byte("\x1f\x8b")):
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to open the gzip stream")
+		}
+		defer reader.Close()
+		return readTar(reader)
+	default:
+		return readTar(bytes.NewReader(data))
+	}
+}
+
+func readZip(data []byte) (map[string][]byte, error) {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open the zip archive")
+	}
+
+	files := map[string][]byte{}
+	var total int64
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+
+		rc, err := file.Open()
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to open %s", file.Name)
+		}
+		content, err := readLimited(rc, &total)
+		rc.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read %s", file.Name)
+		}
+
+		files[cleanName(file.Name)] = content
+	}
+
+	return files, nil
+}
+
+func readTar(r io.Reader) (map[string][]byte, error) {
+	reader := tar.NewReader(r)
+
+	files := map[string][]byte{}
+	var total int64
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read the tar archive")
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		content, err := readLimited(reader, &total)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read %s", header.Name)
+		}
+
+		files[cleanName(header.Name)] = content
+	}
+
+	return files, nil
+}
+
+func readLimited(r io.Reader, total *int64) ([]byte, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(r, MaxArchiveSize-*total+1))
+	if err != nil {
+		return nil, err
+	}
+	*total += int64(len(content))
+	if *total > MaxArchiveSize {
+		return nil, errors.New("archive is too large")
+	}
+	return content, nil
+}
+
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
@@ -0,0 +1,152 @@
+package http
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type archiveFile struct {
+	name    string
+	content []byte
+}
+
+func zipArchive(t *testing.T, files []archiveFile) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, file := range files {
+		f, err := w.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(file.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarArchive(t *testing.T, files []archiveFile, gzipped bool) []byte {
+	var (
+		buf bytes.Buffer
+		gz  *gzip.Writer
+		out io.Writer = &buf
+	)
+	if gzipped {
+		gz = gzip.NewWriter(&buf)
+		out = gz
+	}
+	w := tar.NewWriter(out)
+	for _, file := range files {
+		header := &tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content)), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(file.name, "/") {
+			header.Typeflag, header.Size = tar.TypeDir, 0
+		}
+		if err := w.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(file.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestReadArchive(t *testing.T) {
+	files := []archiveFile{
+		{"index.html", []byte("<img src=a.png>")},
+		{"./img/a.png", []byte("png")},
+		{"../../etc/passwd", []byte("root")},
+		{"/abs/b.css", []byte("css")},
+		{"img/../../../c.js", []byte("js")},
+	}
+	want := map[string][]byte{
+		"index.html": []byte("<img src=a.png>"),
+		"img/a.png":  []byte("png"),
+		"etc/passwd": []byte("root"),
+		"abs/b.css":  []byte("css"),
+		"c.js":       []byte("js"),
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"zip", zipArchive(t, files)},
+		{"tar", tarArchive(t, files, false)},
+		{"tar.gz", tarArchive(t, files, true)},
+		{"tar with a directory", tarArchive(t, append([]archiveFile{{"img/", nil}}, files...), false)},
+	}
+	for _, test := range tests {
+		got, err := ReadArchive(test.data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: ReadArchive() = %q, expected %q", test.name, got, want)
+		}
+	}
+}
+
+func TestReadArchiveSize(t *testing.T) {
+	half := bytes.Repeat([]byte{0}, MaxArchiveSize/2)
+
+	tests := []struct {
+		name  string
+		files []archiveFile
+		err   bool
+	}{
+		{"at the limit", []archiveFile{{"a", half}, {"b", half}}, false},
+		{"one file over the limit", []archiveFile{{"a", append(append([]byte{}, half...), half...)}, {"b", []byte{0}}}, true},
+		{"the files over the limit", []archiveFile{{"a", half}, {"b", half}, {"c", []byte{0}}}, true},
+	}
+	for _, test := range tests {
+		for _, format := range []string{"zip", "tar.gz"} {
+			data := zipArchive(t, test.files)
+			if format == "tar.gz" {
+				data = tarArchive(t, test.files, true)
+			}
+
+			_, err := ReadArchive(data)
+			if test.err && (err == nil || !strings.Contains(err.Error(), "archive is too large")) {
+				t.Errorf("%s %s: ReadArchive() = %v, expected the archive to be too large", test.name, format, err)
+			}
+			if !test.err && err != nil {
+				t.Errorf("%s %s: ReadArchive() = %v", test.name, format, err)
+			}
+		}
+	}
+}
+
+func TestReadArchiveInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated zip", zipArchive(t, []archiveFile{{"index.html", []byte("html")}})[:20]},
+		{"truncated gzip", []byte("\x1f\x8b\x08")},
+		{"garbage", []byte("not an archive at all, but long enough to hold a tar header")},
+	}
+	for _, test := range tests {
+		if _, err := ReadArchive(test.data); err == nil {
+			t.Errorf("%s: ReadArchive() succeeded, expected an error", test.name)
+		}
+	}
+}
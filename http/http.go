@@ -1,35 +1,89 @@
 package http
 
 import (
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	"path"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
 )
 
+// Bundle is an HTML document together with the assets it references. The
+// document is served at /<key>/ and every asset at /<key>/<name>.
+type Bundle struct {
+	HTML    string
+	Assets  map[string][]byte
+	Headers map[string]string // extra response headers, eg. Content-Security-Policy
+	Expires time.Time         // zero means the bundle never expires
+}
+
 type HTTP struct {
-	Data map[string]string
-	mu   sync.RWMutex
+	Data map[string]*Bundle
+	// AllowedRemotes restricts which clients may fetch the bundles, nil
+	// allows everyone.
+	AllowedRemotes []*net.IPNet
+	mu             sync.RWMutex
+}
+
+// NewKey returns an unguessable key for a bundle.
+func NewKey() string {
+	return uniuri.NewLen(uniuri.UUIDLen)
 }
 
 func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if len(r.RequestURI) < 2 {
+	if !h.allowed(r.RemoteAddr) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if len(r.URL.Path) < 2 {
 		http.Error(w, "uri too short", http.StatusBadRequest)
 		return
 	}
 
+	parts := strings.SplitN(r.URL.Path[1:], "/", 2)
+	key := parts[0]
+
 	h.mu.RLock()
-	val, ok := h.Data[r.RequestURI[1:]]
+	bundle, ok := h.Data[key]
 	h.mu.RUnlock()
-	if !ok {
+	if !ok || bundle.expired(time.Now()) {
 		http.Error(w, "key not found", http.StatusNotFound)
 		return
 	}
 
-	w.Write([]byte(val))
+	for name, value := range bundle.Headers {
+		w.Header().Set(name, value)
+	}
+
+	if len(parts) == 1 || parts[1] == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(bundle.HTML))
+		return
+	}
+
+	asset, ok := bundle.Assets[parts[1]]
+	if !ok {
+		http.Error(w, "asset not found", http.StatusNotFound)
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(parts[1]))
+	if contentType == "" {
+		contentType = http.DetectContentType(asset)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(asset)
 }
 
-func (h *HTTP) Set(key string, value string) {
+func (h *HTTP) Set(key string, bundle *Bundle) {
 	h.mu.Lock()
-	h.Data[key] = value
+	h.Data[key] = bundle
 	h.mu.Unlock()
 }
 
@@ -38,3 +92,50 @@ func (h *HTTP) Delete(key string) {
 	delete(h.Data, key)
 	h.mu.Unlock()
 }
+
+// Collect removes the expired bundles every interval, so that entries leaked
+// by jobs which never got to Delete don't pile up.
+func (h *HTTP) Collect(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		h.mu.Lock()
+		for key, bundle := range h.Data {
+			if bundle.expired(now) {
+				delete(h.Data, key)
+				log.Printf("Collected the expired bundle %s", key)
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *HTTP) allowed(remoteAddr string) bool {
+	return allowedRemote(h.AllowedRemotes, remoteAddr)
+}
+
+// allowedRemote reports whether the remote address is in one of the
+// networks, nil networks allow every address.
+func allowedRemote(remotes []*net.IPNet, remoteAddr string) bool {
+	if remotes == nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range remotes {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bundle) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
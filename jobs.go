@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/benmanns/goworker"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// States of a job.
+const (
+	JobQueued     = "queued"
+	JobRunning    = "running"
+	JobUploading  = "uploading"
+	JobDelivering = "delivering"
+	JobDone       = "done"
+	JobFailed     = "failed"
+	JobCancelled  = "cancelled"
+)
+
+// jobCounts counts the finished jobs by their state, served at /metrics.
+var jobCounts = expvar.NewMap("jobs")
+
+// serveMetrics serves jobCounts alone, the other expvars include the command
+// line with its secrets.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\"jobs\": %s}\n", jobCounts)
+}
+
+// jobIDPattern restricts the caller supplied job IDs, which end up in the
+// redis keys and the s3 keys.
+var jobIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+
+// jobStatus is the state of a job as stored in redis and served at
+// /jobs/<id>.
+type jobStatus struct {
+	ID      string            `json:"id"`
+	Class   string            `json:"class"`
+	Queue   string            `json:"queue"`
+	Tenant  string            `json:"tenant,omitempty"`
+	State   string            `json:"state"`
+	Error   string            `json:"error,omitempty"` // reason of the failure
+	URL     string            `json:"url,omitempty"`   // s3 location of the image
+	URLs    map[string]string `json:"urls,omitempty"`  // s3 location of the artifacts
+	Created time.Time         `json:"created"`
+	Updated time.Time         `json:"updated"`
+}
+
+func validateJobID(id string) error {
+	if id != "" && !jobIDPattern.MatchString(id) {
+		return errors.Errorf("invalid job id %q, expected up to 128 letters, digits, dots, dashes or underscores", id)
+	}
+	return nil
+}
+
+func newJobStatus(id, class, queue, tenant string) *jobStatus {
+	now := time.Now().UTC()
+	return &jobStatus{
+		ID:      id,
+		Class:   class,
+		Queue:   queue,
+		Tenant:  tenant,
+		Created: now,
+		Updated: now,
+	}
+}
+
+// set moves the job to the state and stores it. The status is informative,
+// so failing to store it doesn't fail the job.
+func (s *jobStatus) set(state string) {
+	s.State = state
+	s.Updated = time.Now().UTC()
+	switch state {
+	case JobDone, JobFailed, JobCancelled:
+		jobCounts.Add(state, 1)
+	}
+	if err := storeJobStatus(s); err != nil {
+		log.Printf("[%s] Unable to store the %s state: %+v", s.ID, state, err)
+	}
+}
+
+// fail marks the job as failed with the reason, err is returned as is.
+func (s *jobStatus) fail(err error) error {
+	s.Error = err.Error()
+	s.set(JobFailed)
+	return err
+}
+
+// jobKey returns the redis key of the job. The job IDs are chosen by the
+// producers, so with tenants the keys are scoped by the tenant of the job.
+func jobKey(tenant, id string) string {
+	if tenants == nil || tenant == "" {
+		return *redisNamespace + "job:" + id
+	}
+	return tenantKey(tenant, "job:"+id)
+}
+
+// objectKey returns the s3 key of a file of the job, under the tenant of
+// the job like its redis keys.
+func objectKey(tenant, name string) string {
+	if tenants == nil || tenant == "" {
+		return name
+	}
+	return tenant + "/" + name
+}
+
+func jobStatusKey(tenant, id string) string {
+	return jobKey(tenant, id)
+}
+
+func storeJobStatus(s *jobStatus) error {
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode the job status")
+	}
+
+	conn, err := goworker.GetConn()
+	if err != nil {
+		return errors.Wrap(err, "unable to get a redis connection")
+	}
+	defer goworker.PutConn(conn)
+
+	if _, err := conn.Do("SET", jobStatusKey(s.Tenant, s.ID), encoded, "EX", jobStatusTTLSeconds()); err != nil {
+		return errors.Wrap(err, "unable to store the job status")
+	}
+	return nil
+}
+
+func jobStatusTTLSeconds() int {
+	if ttl := int(*jobStatusTTL / time.Second); ttl > 0 {
+		return ttl
+	}
+	return 1
+}
+
+// loadJobStatus returns the stored status of the job of the tenant, nil if
+// there is none.
+func loadJobStatus(tenant, id string) (*jobStatus, error) {
+	if !jobIDPattern.MatchString(id) {
+		return nil, nil
+	}
+
+	conn, err := goworker.GetConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get a redis connection")
+	}
+	defer goworker.PutConn(conn)
+
+	encoded, err := redis.Bytes(conn.Do("GET", jobStatusKey(tenant, id)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load the job status")
+	}
+
+	status := &jobStatus{}
+	if err := json.Unmarshal(encoded, status); err != nil {
+		return nil, errors.Wrap(err, "unable to decode the job status")
+	}
+	if tenant != "" && status.Tenant != tenant {
+		return nil, nil
+	}
+	return status, nil
+}
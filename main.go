@@ -2,27 +2,71 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/benmanns/goworker"
 	"github.com/minio/minio-go"
+	"github.com/pkg/errors"
 
 	https "github.com/reinho/cdp-screenshots/http"
 	"github.com/reinho/cdp-screenshots/process"
+	"github.com/reinho/cdp-screenshots/screenshot"
 )
 
 var (
 	redisURI               = flag.String("redis_uri", "redis://redis:6379/", "redis uri")
+	redisConnections       = flag.Int("redis_connections", 32, "size of the redis connection pool")
+	redisNamespace         = flag.String("redis_namespace", "resque:", "prefix of the redis keys of the queues, jobs, tenants and hosts")
+	pollInterval           = flag.Duration("poll_interval", time.Second, "how long to wait before polling the queues again when they are empty")
 	chromePath             = flag.String("chrome_path", "google-chrome", "google chrome path")
 	chromeFlags            = flag.String("chrome_flags", "--headless,--disable-gpu,--remote-debugging-port=9222,--no-sandbox,--hide-scrollbars", "google chrome flags")
+	chromeCapacity         = flag.Int("chrome_capacity", 25, "how many pages are rendered at once")
+	queues                 = flag.String("job_queues", "screenshots", "comma separated queues, highest priority first, each optionally with its percentage of chrome_capacity, eg. interactive,bulk:60")
 	screenshotsPerInstance = flag.Int("screenshots_per_instance", 1000, "screenshots per a chrome restart")
 	chromeStartDelay       = flag.Duration("chrome_start_delay", 3*time.Second, "how much time to wait after chrome starts")
 	httpBind               = flag.String("http_bind", ":8001", "port of the html server")
+	httpAllowedRemotes     = flag.String("http_allowed_remotes", "127.0.0.0/8,::1/128", "comma separated CIDRs allowed to access the html server")
+	apiBind                = flag.String("api_bind", ":8002", "port of the api serving the job status, the usage and the metrics")
+	apiAllowedRemotes      = flag.String("api_allowed_remotes", "127.0.0.0/8,::1/128", "comma separated CIDRs allowed to access the api, everyone if empty")
+	htmlTTL                = flag.Duration("html_ttl", 5*time.Minute, "how long the html of a job stays on the html server at most")
+	htmlMode               = flag.String("html_mode", "http", "how to load html jobs: http (html server), document (Page.setDocumentContent) or data (data url), the jobs with assets, html_headers or a geolocation always use http")
+	htmlBaseURL            = flag.String("html_base_url", "", "base url of relative links in html jobs loaded in the document or data mode")
 	screenshotTimeout      = flag.Duration("screenshot_timeout", 5*time.Second, "how long should it take to take the screenshot")
 	callbackTimeout        = flag.Duration("callback_timeout", 5*time.Second, "length of the callback timeout")
+	jobStatusTTL           = flag.Duration("job_status_ttl", 24*time.Hour, "how long the status of a job stays available at /jobs/<id> after its last change")
+	cancelCheckInterval    = flag.Duration("cancel_check_interval", 500*time.Millisecond, "how often to check whether the running jobs were cancelled")
+
+	lazyLoadMaxDuration = flag.Duration("lazy_load_max_duration", 30*time.Second, "maximum time spent scrolling through a full page capture")
+
+	hostMaxConcurrent = flag.Int("host_max_concurrent", 4, "how many jobs navigate to the same host at once, unlimited if 0, the subresources and the requests of the page aren't limited")
+	hostMaxRate       = flag.Int("host_max_rate", 0, "how many jobs navigate to the same host per second, unlimited if 0, the subresources and the requests of the page aren't limited")
+	hostLimits        = flag.String("host_limits", "", "comma separated per host overrides of host_max_concurrent and host_max_rate as host=concurrent:rate, eg. example.com=2:1,*.example.org=8:0")
+
+	tenantsFile = flag.String("tenants_file", "", "JSON list of the tenants with their api keys and limits, every job has to name one of them when set")
+
+	batchConcurrency = flag.Int("batch_concurrency", 4, "how many targets of a batch are rendered at once")
+	batchMaxTargets  = flag.Int("batch_max_targets", 1000, "maximum number of targets in a batch")
+
+	animationMaxDuration = flag.Duration("animation_max_duration", 10*time.Second, "maximum length of an animated capture")
+	animationMaxFrames   = flag.Int("animation_max_frames", 100, "maximum number of frames of an animated capture")
+	animationMaxSize     = flag.Int("animation_max_size", 10<<20, "maximum size of an animated capture in bytes")
+
+	adBlocking       = flag.Bool("ad_blocking", false, "block ads and trackers in every job")
+	blockedURLs      = flag.String("blocked_urls", "", "comma separated url patterns to block in every job")
+	blocklistFile    = flag.String("blocklist_file", "", "file with the ad and tracker url patterns, bundled list by default")
+	blocklistRefresh = flag.Duration("blocklist_refresh", time.Minute, "how often to check the blocklist file for changes")
+
+	consoleMaxEntries = flag.Int("console_max_entries", screenshot.DefaultMaxConsoleEntries, "maximum number of console messages, exceptions and failed requests each reported per job")
+	consoleMaxLength  = flag.Int("console_max_length", screenshot.DefaultMaxConsoleLength, "maximum length of a single console message in bytes")
+
+	denyPrivateNetworks = flag.Bool("deny_private_networks", true, "deny requests to private, loopback and link-local addresses")
+	allowedHosts        = flag.String("allowed_hosts", "", "comma separated hosts, host:port pairs or CIDRs exempt from deny_private_networks")
 
 	s3Endpoint = flag.String("s3_endpoint", "localstack:8000", "s3 endpoint")
 	s3UseSSL   = flag.Bool("s3_use_ssl", false, "use ssl for s3?")
@@ -42,6 +86,21 @@ var (
 func main() {
 	flag.Parse()
 
+	if err := loadConfig(flag.CommandLine, *configFile); err != nil {
+		log.Fatalf("Unable to load the configuration: %+v", err)
+	}
+	if *printConfig {
+		fmt.Print(dumpConfig())
+		if err := validateConfig(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := validateConfig(); err != nil {
+		log.Fatal(err)
+	}
+
 	var err error
 	s3Service, err = minio.New(*s3Endpoint, *s3KeyID, *s3Secret, *s3UseSSL)
 	if err != nil {
@@ -58,6 +117,24 @@ func main() {
 		}
 	}
 
+	if *blocklistFile != "" {
+		if err := reloadBlocklist(*blocklistFile); err != nil {
+			log.Fatalf("Unable to load the blocklist: %+v", err)
+		}
+		go watchBlocklist(*blocklistFile, *blocklistRefresh)
+	}
+
+	hostOverrides, err = parseHostLimits(*hostLimits)
+	if err != nil {
+		log.Fatalf("Invalid host_limits: %+v", err)
+	}
+
+	if *tenantsFile != "" {
+		if err := loadTenants(*tenantsFile); err != nil {
+			log.Fatalf("Unable to load the tenants: %+v", err)
+		}
+	}
+
 	chromeProcess, err = process.New(
 		*screenshotsPerInstance,
 		*chromeStartDelay,
@@ -68,29 +145,119 @@ func main() {
 		log.Fatalf("Unable to start Chrome: %+v", err)
 	}
 
+	jobQueues, err = parseQueues(*queues, *chromeCapacity)
+	if err != nil {
+		log.Fatalf("Invalid queues: %+v", err)
+	}
+
+	// The queues are polled by pollQueues, goworker provides the redis pool
 	goworker.SetSettings(goworker.WorkerSettings{
-		URI:            *redisURI,
-		Connections:    32,
-		Queues:         []string{"screenshots"},
-		UseNumber:      true,
-		ExitOnComplete: false,
-		Concurrency:    25,
-		Namespace:      "resque:",
-		Interval:       1.0,
+		URI:         *redisURI,
+		Connections: *redisConnections,
+		Queues:      queueNames(jobQueues),
+		UseNumber:   true,
+		Namespace:   *redisNamespace,
 	})
 
-	goworker.Register("Screenshot", screenshotWorker)
+	// The job status store shares the redis pool of goworker, which has to
+	// exist before the api serves /jobs/<id>
+	if err := goworker.Init(); err != nil {
+		log.Fatalf("Unable to connect to redis: %+v", err)
+	}
+
+	go watchCancellations(*cancelCheckInterval)
+
+	api := &https.API{
+		Jobs: func(tenant, id string) (interface{}, error) {
+			status, err := loadJobStatus(tenant, id)
+			if status == nil {
+				return nil, err
+			}
+			return status, nil
+		},
+		Cancel: func(tenant, id string) (interface{}, bool, error) {
+			status, ok, err := requestCancel(tenant, id)
+			if status == nil {
+				return nil, ok, err
+			}
+			return status, ok, nil
+		},
+		Metrics: http.HandlerFunc(serveMetrics),
+	}
+	if tenants != nil {
+		api.Tenant = tenantByAPIKey
+		api.Usage = func(tenant, date string) (interface{}, error) {
+			if date == "" {
+				date = usageDate(time.Now())
+			}
+			usage, err := loadUsage(tenant, date)
+			if usage == nil {
+				return nil, err
+			}
+			return usage, nil
+		}
+	}
+	api.AllowedRemotes, err = parseCIDRs(*apiAllowedRemotes)
+	if err != nil {
+		log.Fatalf("Invalid api_allowed_remotes: %+v", err)
+	}
+	go func() {
+		if err := http.ListenAndServe(*apiBind, api); err != nil {
+			log.Fatal(err)
+		}
+	}()
 
 	httpServer = &https.HTTP{
-		Data: map[string]string{},
+		Data: map[string]*https.Bundle{},
+	}
+	httpServer.AllowedRemotes, err = parseCIDRs(*httpAllowedRemotes)
+	if err != nil {
+		log.Fatalf("Invalid http_allowed_remotes: %+v", err)
 	}
+	go httpServer.Collect(*htmlTTL)
 	go func() {
 		if err := http.ListenAndServe(*httpBind, httpServer); err != nil {
 			log.Fatal(err)
 		}
 	}()
 
-	if err := goworker.Work(); err != nil {
-		log.Fatal(err)
+	// Batches take a slot of their queue per target
+	pollQueues(*chromeCapacity, *pollInterval, map[string]*jobClass{
+		"Screenshot": {run: screenshotWorker},
+		"Batch":      {run: batchWorker, perTarget: true},
+	})
+	goworker.Close()
+}
+
+// httpServerURL returns the base URL under which Chrome reaches the html
+// server bound to http_bind.
+func httpServerURL() string {
+	host, port, err := net.SplitHostPort(*httpBind)
+	if err != nil {
+		return "http://" + *httpBind
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// parseCIDRs parses a comma separated list of CIDRs.
+func parseCIDRs(value string) ([]*net.IPNet, error) {
+	var ipnets []*net.IPNet
+	for _, cidr := range splitList(value) {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid entry %s", cidr)
+		}
+		ipnets = append(ipnets, ipnet)
+	}
+	return ipnets, nil
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return nil
 	}
+	return strings.Split(value, ",")
 }
@@ -1,5 +1,15 @@
 package main
 
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+
+	https "github.com/reinho/cdp-screenshots/http"
+	"github.com/reinho/cdp-screenshots/screenshot"
+)
+
 type Message struct {
 	HTML         string  `json:"html"` // either HTML or URL, preferred HTML
 	URL          string  `json:"url"`
@@ -8,10 +18,338 @@ type Message struct {
 	Scaling      float64 `json:"scaling"`   // 1.00 by default
 	Delay        int64   `json:"delay"`     // in ms
 	FullPage     bool    `json:"full_page"` // take a screenshot of the full page
-	Format       string  `json:"format"`    // jpeg or png
+	Format       string  `json:"format"`    // jpeg, png or gif
 	Quality      int64   `json:"quality"`
 	Callback     string  `json:"callback"`      // url of the callback
 	CallbackType string  `json:"callback_type"` // "blob" or "s3", "blob" by default
+
+	// Optional settings, passed as a JSON object after the positional args
+	JobID       string            `json:"job_id"`       // status key at /jobs/<id> and prefix of the s3 keys, generated by default
+	Tenant      string            `json:"tenant"`       // team the job is attributed and limited to, required with tenants_file
+	Queue       string            `json:"queue"`        // moves the job to this queue unless it's already there
+	AdBlocking  bool              `json:"ad_blocking"`  // block ads and known trackers
+	BlockedURLs []string          `json:"blocked_urls"` // additional URL patterns to block
+	Assets      map[string][]byte `json:"assets"`       // base64 files served next to the HTML
+	Archive     []byte            `json:"archive"`      // base64 zip or tar of the assets, index.html is used when HTML is empty
+	HTMLHeaders map[string]string `json:"html_headers"` // extra response headers for the HTML and its assets
+
+	// Animated captures, enabled by the "gif" format
+	AnimationDuration  int64 `json:"animation_duration"`   // in ms, 3000 by default
+	AnimationFrameRate int64 `json:"animation_frame_rate"` // frames per second, 10 by default
+	AnimationFrames    bool  `json:"animation_frames"`     // also deliver a zip of the png frames
+
+	EmulatedMedia string            `json:"emulated_media"` // screen or print
+	MediaFeatures map[string]string `json:"media_features"` // eg. {"prefers-color-scheme": "dark"}
+
+	Timezone    string                  `json:"timezone"`    // IANA timezone ID, eg. "Europe/Prague"
+	Locale      string                  `json:"locale"`      // eg. "de-AT", also sent as Accept-Language
+	Geolocation *screenshot.Geolocation `json:"geolocation"` // position granted to the page
+
+	LazyLoad      *LazyLoadOptions      `json:"lazy_load"`     // scroll through the page before a full page capture
+	Deterministic *DeterministicOptions `json:"deterministic"` // byte-stable output for identical input
+
+	Steps   []screenshot.Step        `json:"steps"`   // interactions with the page before the capture
+	Dialogs *screenshot.DialogPolicy `json:"dialogs"` // how alerts, confirms and prompts are resolved
+
+	Viewports []screenshot.Viewport `json:"viewports"` // one image per viewport, delivered as labelled artifacts
+
+	Compare     *CompareOptions `json:"compare"`     // visual regression check against a baseline
+	Fingerprint bool            `json:"fingerprint"` // perceptual hashes and dominant colours of the image
+
+	SerializedDOM bool `json:"serialized_dom"` // store the final markup of the page as dom.html
+	MHTML         bool `json:"mhtml"`          // store a web archive of the page as page.mhtml
+	HAR           bool `json:"har"`            // store the network activity of the page as page.har
+	Performance   bool `json:"performance"`    // collect the performance metrics of the page
+
+	FailOnException bool `json:"fail_on_exception"` // fail the job when the page throws an uncaught exception
+}
+
+// CompareOptions requests a comparison of the screenshot with a baseline
+// image, given either inline or as a key in the s3 bucket.
+type CompareOptions struct {
+	Baseline           []byte              `json:"baseline"`     // base64 png or jpeg
+	BaselineKey        string              `json:"baseline_key"` // key of the baseline in the s3 bucket
+	Threshold          float64             `json:"threshold"`    // maximum mismatch in percent that passes
+	Tolerance          int                 `json:"tolerance"`    // per channel difference ignored, 0-255
+	IgnoreAntialiasing bool                `json:"ignore_antialiasing"`
+	IgnoreRegions      []screenshot.Region `json:"ignore_regions"`
+}
+
+// LazyLoadOptions configures scrolling through the page to trigger the lazy
+// loaded content before a full page capture.
+type LazyLoadOptions struct {
+	Step        int64 `json:"step"`         // in pixels, the viewport height by default
+	Pause       int64 `json:"pause"`        // in ms after each step, 100 by default
+	MaxDuration int64 `json:"max_duration"` // in ms, 10000 by default
+}
+
+// DeterministicOptions enables the deterministic mode, which also disables
+// the animations and the caret.
+type DeterministicOptions struct {
+	VirtualTimeBudget int64  `json:"virtual_time_budget"` // in virtual ms, real time if 0
+	Seed              *int64 `json:"seed"`                // of Math.random
+	Clock             string `json:"clock"`               // RFC 3339 time Date stops at
+}
+
+// parseMessage builds a Message out of the positional job arguments. An
+// optional object following them is decoded onto the optional settings. An
+// invalid message is returned along with the error, so that it can be
+// rejected.
+func parseMessage(args []interface{}) (*Message, error) {
+	msg := &Message{
+		HTML:         args[0].(string),
+		URL:          args[1].(string),
+		Width:        mustInt64(args[2].(json.Number).Int64()),
+		Height:       mustInt64(args[3].(json.Number).Int64()),
+		Scaling:      mustFloat64(args[4].(json.Number).Float64()),
+		Delay:        mustInt64(args[5].(json.Number).Int64()),
+		FullPage:     args[6].(bool),
+		Format:       args[7].(string),
+		Quality:      mustInt64(args[8].(json.Number).Int64()),
+		Callback:     args[9].(string),
+		CallbackType: args[10].(string),
+	}
+
+	if len(args) > 11 && args[11] != nil {
+		options, err := json.Marshal(args[11])
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to encode the options")
+		}
+		if err := json.Unmarshal(options, msg); err != nil {
+			return nil, errors.Wrap(err, "unable to decode the options")
+		}
+	}
+
+	if err := msg.Validate(); err != nil {
+		return msg, err
+	}
+
+	return msg, nil
+}
+
+// Validate checks the optional settings which can be checked before
+// rendering.
+func (m *Message) Validate() error {
+	if err := validateJobID(m.JobID); err != nil {
+		return err
+	}
+	if err := screenshot.ValidateMedia(m.EmulatedMedia, m.MediaFeatures); err != nil {
+		return err
+	}
+	if err := screenshot.ValidateLocale(m.Locale); err != nil {
+		return err
+	}
+	// The labels name the artifacts, a duplicate would overwrite another one
+	labels := make(map[string]bool, len(m.Steps)+len(m.Viewports))
+	for i := range m.Steps {
+		if err := m.Steps[i].Validate(); err != nil {
+			return errors.Wrapf(err, "invalid step %d", i)
+		}
+		if !m.Steps[i].Capture {
+			continue
+		}
+		label := m.Steps[i].Name(i)
+		if labels[label] {
+			return errors.Errorf("invalid step %d, the label %s is already taken", i, label)
+		}
+		labels[label] = true
+	}
+	for i := range m.Viewports {
+		if err := m.Viewports[i].Validate(); err != nil {
+			return errors.Wrapf(err, "invalid viewport %d", i)
+		}
+		label := m.Viewports[i].Name()
+		if labels[label] {
+			return errors.Errorf("invalid viewport %d, the label %s is already taken", i, label)
+		}
+		labels[label] = true
+	}
+	// Both analyse the main image, which viewports and animations replace
+	if (m.Compare != nil || m.Fingerprint) && (len(m.Viewports) > 0 || m.Format == "gif") {
+		return errors.New("compare and fingerprint can't be combined with viewports or a gif animation")
+	}
+	if _, err := m.Determinism(); err != nil {
+		return err
+	}
+	if m.Dialogs != nil {
+		if err := m.Dialogs.Validate(); err != nil {
+			return err
+		}
+	}
+	if m.Geolocation != nil {
+		if err := m.Geolocation.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Animation returns the settings of an animated capture, nil unless the
+// format is "gif".
+func (m *Message) Animation() (*screenshot.Animation, error) {
+	if m.Format != "gif" {
+		return nil, nil
+	}
+
+	animation := &screenshot.Animation{
+		Duration:  time.Duration(m.AnimationDuration) * time.Millisecond,
+		FrameRate: int(m.AnimationFrameRate),
+		MaxFrames: *animationMaxFrames,
+		MaxSize:   *animationMaxSize,
+		Frames:    m.AnimationFrames,
+	}
+	if animation.Duration <= 0 {
+		animation.Duration = 3 * time.Second
+	}
+	if animation.Duration > *animationMaxDuration {
+		return nil, errors.Errorf("animation duration %s exceeds the limit of %s", animation.Duration, *animationMaxDuration)
+	}
+	return animation, nil
+}
+
+// RenderTimeout is the time needed to render the page and record the
+// animation.
+func (m *Message) RenderTimeout() (time.Duration, error) {
+	animation, err := m.Animation()
+	if err != nil {
+		return 0, err
+	}
+
+	timeout := time.Duration(m.Delay)*time.Millisecond + *screenshotTimeout
+	if animation != nil {
+		timeout += animation.Duration
+	}
+	for i := range m.Steps {
+		timeout += m.Steps[i].MaxDuration()
+	}
+	if lazy := m.LazyLoading(); lazy != nil {
+		timeout += lazy.MaxDuration
+	}
+	if m.Deterministic != nil {
+		timeout += time.Duration(m.Deterministic.VirtualTimeBudget) * time.Millisecond
+	}
+	return timeout, nil
+}
+
+// Captures is the number of images the job renders at most, the main image
+// or one per viewport along with the captures of the steps.
+func (m *Message) Captures() int {
+	captures := 1
+	if len(m.Viewports) > 0 {
+		captures = len(m.Viewports)
+	}
+	for i := range m.Steps {
+		if m.Steps[i].Capture {
+			captures++
+		}
+	}
+	return captures
+}
+
+// LazyLoading returns the lazy load settings, nil unless requested for a full
+// page capture.
+func (m *Message) LazyLoading() *screenshot.LazyLoad {
+	if m.LazyLoad == nil || !m.FullPage {
+		return nil
+	}
+
+	lazy := &screenshot.LazyLoad{
+		StepSize:    int(m.LazyLoad.Step),
+		Pause:       time.Duration(m.LazyLoad.Pause) * time.Millisecond,
+		MaxDuration: time.Duration(m.LazyLoad.MaxDuration) * time.Millisecond,
+	}
+	if lazy.MaxDuration <= 0 {
+		lazy.MaxDuration = 10 * time.Second
+	}
+	if lazy.MaxDuration > *lazyLoadMaxDuration {
+		lazy.MaxDuration = *lazyLoadMaxDuration
+	}
+	return lazy
+}
+
+// Determinism returns the settings of the deterministic mode, nil unless
+// requested.
+func (m *Message) Determinism() (*screenshot.Deterministic, error) {
+	if m.Deterministic == nil {
+		return nil, nil
+	}
+
+	det := &screenshot.Deterministic{
+		VirtualTimeBudget: time.Duration(m.Deterministic.VirtualTimeBudget) * time.Millisecond,
+		Seed:              m.Deterministic.Seed,
+	}
+	if det.VirtualTimeBudget < 0 {
+		return nil, errors.New("the virtual time budget can't be negative")
+	}
+	if m.Deterministic.Clock != "" {
+		clock, err := time.Parse(time.RFC3339, m.Deterministic.Clock)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid clock")
+		}
+		det.Clock = clock
+	}
+	return det, nil
+}
+
+// Comparison returns the settings of the visual regression check, fetching
+// the baseline from s3 if needed.
+func (m *Message) Comparison() (*screenshot.Comparison, error) {
+	if m.Compare == nil {
+		return nil, nil
+	}
+
+	baseline := m.Compare.Baseline
+	if baseline == nil {
+		if m.Compare.BaselineKey == "" {
+			return nil, errors.New("either baseline or baseline_key is required")
+		}
+
+		var err error
+		baseline, err = download(m.Compare.BaselineKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &screenshot.Comparison{
+		Baseline:           baseline,
+		Threshold:          m.Compare.Threshold,
+		Tolerance:          m.Compare.Tolerance,
+		IgnoreAntialiasing: m.Compare.IgnoreAntialiasing,
+		IgnoreRegions:      m.Compare.IgnoreRegions,
+	}, nil
+}
+
+// Bundle prepares the HTML of the message and its assets for the HTML server.
+func (m *Message) Bundle() (*https.Bundle, error) {
+	bundle := &https.Bundle{
+		HTML:    m.HTML,
+		Assets:  map[string][]byte{},
+		Headers: m.HTMLHeaders,
+	}
+
+	if m.Archive != nil {
+		files, err := https.ReadArchive(m.Archive)
+		if err != nil {
+			return nil, err
+		}
+		for name, content := range files {
+			bundle.Assets[name] = content
+		}
+	}
+	for name, content := range m.Assets {
+		bundle.Assets[name] = content
+	}
+
+	if bundle.HTML == "" {
+		index, ok := bundle.Assets["index.html"]
+		if !ok {
+			return nil, errors.New("neither html nor index.html were provided")
+		}
+		bundle.HTML = string(index)
+	}
+
+	return bundle, nil
 }
 
 func mustFloat64(val float64, err error) float64 {
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/benmanns/goworker"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// requeueDelay is how long a deferred job waits before it goes back to its
+// queue, and how often a batch checks the limits of a busy host.
+const requeueDelay = 100 * time.Millisecond
+
+// jobQueue is a resque queue along with its share of the Chrome capacity.
+type jobQueue struct {
+	Name  string
+	Share int // percentage of chrome_capacity
+	slots chan struct{}
+}
+
+// jobQueues are the configured queues, highest priority first.
+var jobQueues []*jobQueue
+
+// renderSlots bound the pages rendered at once to chrome_capacity, across
+// all queues.
+var renderSlots chan struct{}
+
+// parseQueues parses the job_queues flag, a comma separated list of queue names
+// in the order of priority, each optionally followed by a colon and its
+// percentage of the capacity, eg. "interactive,bulk:60". A queue without a
+// share may use all of the capacity.
+func parseQueues(value string, capacity int) ([]*jobQueue, error) {
+	if capacity <= 0 {
+		return nil, errors.New("the capacity must be greater than 0")
+	}
+
+	var queues []*jobQueue
+	seen := map[string]bool{}
+	for _, entry := range splitList(value) {
+		parts := strings.SplitN(entry, ":", 2)
+
+		q := &jobQueue{
+			Name:  strings.TrimSpace(parts[0]),
+			Share: 100,
+		}
+		if q.Name == "" {
+			return nil, errors.Errorf("the queue %q has no name", entry)
+		}
+		if seen[q.Name] {
+			return nil, errors.Errorf("the queue %s is listed twice", q.Name)
+		}
+		seen[q.Name] = true
+
+		if len(parts) == 2 {
+			share, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(parts[1]), "%"))
+			if err != nil || share <= 0 || share > 100 {
+				return nil, errors.Errorf("invalid share of the queue %s: %s", q.Name, parts[1])
+			}
+			q.Share = share
+		}
+
+		slots := (capacity*q.Share + 99) / 100
+		if slots < 1 {
+			slots = 1
+		}
+		q.slots = make(chan struct{}, slots)
+
+		queues = append(queues, q)
+	}
+	if len(queues) == 0 {
+		return nil, errors.New("no queues configured")
+	}
+
+	return queues, nil
+}
+
+// queueNames returns the names of the queues in the order of priority.
+func queueNames(queues []*jobQueue) []string {
+	names := make([]string, 0, len(queues))
+	for _, q := range queues {
+		names = append(names, q.Name)
+	}
+	return names
+}
+
+func findQueue(name string) *jobQueue {
+	for _, q := range jobQueues {
+		if q.Name == name {
+			return q
+		}
+	}
+	return nil
+}
+
+// acquire waits for a slot of the queue.
+func (q *jobQueue) acquire() {
+	q.slots <- struct{}{}
+}
+
+func (q *jobQueue) release() {
+	<-q.slots
+}
+
+// pushJob adds the job to the tail of the queue.
+func pushJob(queue, class string, args []interface{}) error {
+	return goworker.Enqueue(&goworker.Job{
+		Queue: queue,
+		Payload: goworker.Payload{
+			Class: class,
+			Args:  args,
+		},
+	})
+}
+
+// deferJob puts the job back to the tail of its queue after a while, letting
+// the other jobs run first.
+func deferJob(status *jobStatus, jobID, queue, class string, args []interface{}, reason error) error {
+	log.Printf("[%s] Deferred: %v", status.ID, reason)
+	time.Sleep(requeueDelay)
+	if jobID != "" {
+		status.set(JobQueued)
+	}
+	return pushJob(queue, class, args)
+}
+
+// routeJob moves the job to the queue named by the message, if it names
+// another one. It reports whether the job was moved.
+func routeJob(queue, named, class string, args []interface{}) (bool, error) {
+	if named == "" || named == queue {
+		return false, nil
+	}
+	if findQueue(named) == nil {
+		return false, errors.Errorf("unknown queue %s", named)
+	}
+
+	if err := pushJob(named, class, args); err != nil {
+		return false, errors.Wrapf(err, "unable to move the job to the %s queue", named)
+	}
+	return true, nil
+}
+
+// jobFunc runs a job of a class with the arguments of its payload.
+type jobFunc func(queue string, args ...interface{}) error
+
+// jobClass is a class of jobs. A job holds a slot of its queue while it
+// runs, unless perTarget is set, in which case it takes a slot for each of
+// its targets instead.
+type jobClass struct {
+	run       jobFunc
+	perTarget bool
+}
+
+// pollQueues runs the jobs of the queues, at most capacity at once, until
+// the process is interrupted. Each poll pops a job from the highest priority
+// queue with a free slot, so that a queue at its share doesn't hold back the
+// queues after it.
+func pollQueues(capacity int, interval time.Duration, classes map[string]*jobClass) {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGQUIT, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(quit)
+
+	worker, err := registerWorker()
+	if err != nil {
+		log.Printf("Unable to register the worker: %+v", err)
+	}
+	defer unregisterWorker(worker)
+
+	renderSlots = make(chan struct{}, capacity)
+	var pending sync.WaitGroup
+	defer pending.Wait()
+
+	for {
+		select {
+		case renderSlots <- struct{}{}:
+		case <-quit:
+			log.Print("Stopped polling, waiting for the running jobs")
+			return
+		}
+
+		job, q, err := popJob()
+		if err != nil {
+			log.Printf("Unable to poll the queues: %+v", err)
+		}
+		if job == nil {
+			<-renderSlots
+			select {
+			case <-time.After(interval):
+				continue
+			case <-quit:
+				log.Print("Stopped polling, waiting for the running jobs")
+				return
+			}
+		}
+
+		class, ok := classes[job.Payload.Class]
+		if !ok || class.perTarget {
+			// The targets of the job take their own slots
+			q.release()
+			<-renderSlots
+		}
+		if !ok {
+			log.Printf("Dropped a job of the unknown class %q from the %s queue", job.Payload.Class, job.Queue)
+			continue
+		}
+
+		pending.Add(1)
+		go func() {
+			defer pending.Done()
+			if !class.perTarget {
+				defer func() { <-renderSlots }()
+				defer q.release()
+			}
+			runJob(worker, class.run, job)
+		}()
+	}
+}
+
+// popJob pops a job from the first queue with a free slot and takes the
+// slot. It returns a nil job when there is none.
+func popJob() (*goworker.Job, *jobQueue, error) {
+	conn, err := goworker.GetConn()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to get a redis connection")
+	}
+	defer goworker.PutConn(conn)
+
+	for _, q := range jobQueues {
+		select {
+		case q.slots <- struct{}{}:
+		default:
+			continue
+		}
+
+		payload, err := redis.Bytes(conn.Do("LPOP", *redisNamespace+"queue:"+q.Name))
+		if err == redis.ErrNil {
+			q.release()
+			continue
+		}
+		if err != nil {
+			q.release()
+			return nil, nil, errors.Wrapf(err, "unable to pop a job from the %s queue", q.Name)
+		}
+
+		job := &goworker.Job{Queue: q.Name}
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		decoder.UseNumber()
+		if err := decoder.Decode(&job.Payload); err != nil {
+			q.release()
+			log.Printf("Dropped an invalid job from the %s queue: %v", q.Name, err)
+			continue
+		}
+		return job, q, nil
+	}
+	return nil, nil, nil
+}
+
+// acquireSlots waits for a slot of the capacity and one of the queue, if
+// any, for a target of a job. It returns the func that releases them.
+func acquireSlots(q *jobQueue) func() {
+	renderSlots <- struct{}{}
+	if q != nil {
+		q.acquire()
+	}
+	return func() {
+		if q != nil {
+			q.release()
+		}
+		<-renderSlots
+	}
+}
+
+// resqueFailure is a failed job, as resque lists them in its failed queue.
+type resqueFailure struct {
+	FailedAt  time.Time        `json:"failed_at"`
+	Payload   goworker.Payload `json:"payload"`
+	Exception string           `json:"exception"`
+	Error     string           `json:"error"`
+	Backtrace []string         `json:"backtrace"`
+	Worker    string           `json:"worker"`
+	Queue     string           `json:"queue"`
+}
+
+// registerWorker adds the process to the resque workers and returns its
+// name, in the format of resque, eg. "host:42-poller:interactive,bulk".
+func registerWorker() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	worker := fmt.Sprintf("%s:%d-poller:%s", hostname, os.Getpid(), strings.Join(queueNames(jobQueues), ","))
+
+	conn, err := goworker.GetConn()
+	if err != nil {
+		return worker, errors.Wrap(err, "unable to get a redis connection")
+	}
+	defer goworker.PutConn(conn)
+
+	conn.Send("SADD", *redisNamespace+"workers", worker)
+	conn.Send("SET", *redisNamespace+"worker:"+worker+":started", time.Now().Format(time.RFC1123Z))
+	if _, err := conn.Do(""); err != nil {
+		return worker, errors.Wrap(err, "unable to register the worker")
+	}
+	return worker, nil
+}
+
+// unregisterWorker removes the worker and its counters from resque.
+func unregisterWorker(worker string) {
+	conn, err := goworker.GetConn()
+	if err != nil {
+		log.Printf("Unable to unregister the worker: %v", err)
+		return
+	}
+	defer goworker.PutConn(conn)
+
+	conn.Send("SREM", *redisNamespace+"workers", worker)
+	conn.Send("DEL", *redisNamespace+"worker:"+worker)
+	conn.Send("DEL", *redisNamespace+"worker:"+worker+":started")
+	conn.Send("DEL", *redisNamespace+"stat:processed:"+worker)
+	conn.Send("DEL", *redisNamespace+"stat:failed:"+worker)
+	if _, err := conn.Do(""); err != nil {
+		log.Printf("Unable to unregister the worker: %v", err)
+	}
+}
+
+// runJob runs the job and records its outcome in resque: a failed job goes
+// to the failed queue, along with its error.
+func runJob(worker string, run jobFunc, job *goworker.Job) {
+	var backtrace []string
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.Errorf("panic: %v", r)
+				backtrace = strings.Split(strings.TrimSpace(string(debug.Stack())), "\n")
+			}
+		}()
+		return run(job.Queue, job.Payload.Args...)
+	}()
+	if err != nil {
+		log.Printf("A %s job of the %s queue failed: %+v", job.Payload.Class, job.Queue, err)
+	}
+
+	if err := recordJob(worker, job, err, backtrace); err != nil {
+		log.Printf("Unable to record a %s job of the %s queue: %+v", job.Payload.Class, job.Queue, err)
+	}
+}
+
+// recordJob counts the job as processed or failed, pushing a failed one to
+// the failed queue.
+func recordJob(worker string, job *goworker.Job, jobErr error, backtrace []string) error {
+	conn, err := goworker.GetConn()
+	if err != nil {
+		return errors.Wrap(err, "unable to get a redis connection")
+	}
+	defer goworker.PutConn(conn)
+
+	if jobErr == nil {
+		conn.Send("INCR", *redisNamespace+"stat:processed")
+		conn.Send("INCR", *redisNamespace+"stat:processed:"+worker)
+		_, err := conn.Do("")
+		return errors.Wrap(err, "unable to count the processed job")
+	}
+
+	if backtrace == nil {
+		backtrace = []string{}
+	}
+	failure, err := json.Marshal(&resqueFailure{
+		FailedAt:  time.Now(),
+		Payload:   job.Payload,
+		Exception: "Error",
+		Error:     jobErr.Error(),
+		Backtrace: backtrace,
+		Worker:    worker,
+		Queue:     job.Queue,
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to encode the failure")
+	}
+
+	conn.Send("RPUSH", *redisNamespace+"failed", failure)
+	conn.Send("INCR", *redisNamespace+"stat:failed")
+	conn.Send("INCR", *redisNamespace+"stat:failed:"+worker)
+	_, err = conn.Do("")
+	return errors.Wrap(err, "unable to push the failed job")
+}
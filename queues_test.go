@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseQueues(t *testing.T) {
+	type queue struct {
+		name  string
+		share int
+		slots int
+	}
+
+	tests := []struct {
+		value    string
+		capacity int
+		queues   []queue
+		err      string
+	}{
+		{"screenshots", 4, []queue{{"screenshots", 100, 4}}, ""},
+		{"interactive,bulk:60", 10, []queue{{"interactive", 100, 10}, {"bulk", 60, 6}}, ""},
+		{" interactive , bulk : 60% ", 10, []queue{{"interactive", 100, 10}, {"bulk", 60, 6}}, ""},
+
+		// the slots are rounded up, to at least one
+		{"bulk:25", 2, []queue{{"bulk", 25, 1}}, ""},
+		{"bulk:1", 4, []queue{{"bulk", 1, 1}}, ""},
+		{"bulk:34", 3, []queue{{"bulk", 34, 2}}, ""},
+		{"bulk:100", 3, []queue{{"bulk", 100, 3}}, ""},
+
+		{"", 4, nil, "no queues configured"},
+		{"interactive", 0, nil, "the capacity must be greater than 0"},
+		{"interactive,:50", 4, nil, "has no name"},
+		{"bulk,bulk:50", 4, nil, "the queue bulk is listed twice"},
+		{"bulk:0", 4, nil, "invalid share of the queue bulk"},
+		{"bulk:101", 4, nil, "invalid share of the queue bulk"},
+		{"bulk:-10", 4, nil, "invalid share of the queue bulk"},
+		{"bulk:half", 4, nil, "invalid share of the queue bulk"},
+		{"bulk:", 4, nil, "invalid share of the queue bulk"},
+	}
+	for _, test := range tests {
+		queues, err := parseQueues(test.value, test.capacity)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("parseQueues(%q, %d) = %v, expected an error containing %q", test.value, test.capacity, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseQueues(%q, %d) = %v", test.value, test.capacity, err)
+			continue
+		}
+
+		if len(queues) != len(test.queues) {
+			t.Errorf("parseQueues(%q, %d) returned %d queues, expected %d", test.value, test.capacity, len(queues), len(test.queues))
+			continue
+		}
+		for i, q := range queues {
+			want := test.queues[i]
+			if q.Name != want.name || q.Share != want.share || cap(q.slots) != want.slots {
+				t.Errorf("parseQueues(%q, %d) queue %d = %s:%d with %d slots, expected %s:%d with %d slots",
+					test.value, test.capacity, i, q.Name, q.Share, cap(q.slots), want.name, want.share, want.slots)
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package screenshot
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/textproto"
+	"time"
+
+	"github.com/mafredri/cdp"
+	"github.com/mafredri/cdp/protocol/dom"
+	"github.com/mafredri/cdp/protocol/page"
+	"github.com/pkg/errors"
+)
+
+// SerializeDOM returns the markup of the document as it is now, after the
+// scripts of the page ran.
+func SerializeDOM(ctx context.Context, client *cdp.Client) (string, error) {
+	doc, err := client.DOM.GetDocument(ctx, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to get the DOM document")
+	}
+
+	reply, err := client.DOM.GetOuterHTML(ctx, dom.NewGetOuterHTMLArgs().SetNodeID(doc.Root.NodeID))
+	if err != nil {
+		return "", errors.Wrap(err, "unable to serialize the DOM document")
+	}
+	return reply.OuterHTML, nil
+}
+
+// BuildMHTML packs the serialized document of the main frame, the documents
+// of the child frames and all the loaded resources into a single MHTML web
+// archive. Resources which can't be fetched are left out.
+func BuildMHTML(ctx context.Context, client *cdp.Client, document string) ([]byte, error) {
+	tree, err := client.Page.GetResourceTree(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get the resource tree")
+	}
+
+	buf := &bytes.Buffer{}
+	archive := multipart.NewWriter(buf)
+
+	fmt.Fprintf(buf, "From: <Saved by cdp-screenshots>\r\n")
+	fmt.Fprintf(buf, "Snapshot-Content-Location: %s\r\n", tree.FrameTree.Frame.URL)
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/related;\r\n\ttype=\"text/html\";\r\n\tboundary=\"%s\"\r\n\r\n", archive.Boundary())
+
+	if err := writeMHTMLPart(archive, tree.FrameTree.Frame.URL, "text/html", []byte(document)); err != nil {
+		return nil, err
+	}
+
+	var walk func(tree *page.FrameResourceTree, main bool) error
+	walk = func(tree *page.FrameResourceTree, main bool) error {
+		if !main {
+			content, err := resourceContent(ctx, client, tree.Frame.ID, tree.Frame.URL)
+			if err != nil {
+				log.Printf("Unable to archive the frame %s: %v", tree.Frame.URL, err)
+			} else if err := writeMHTMLPart(archive, tree.Frame.URL, "text/html", content); err != nil {
+				return err
+			}
+		}
+
+		for _, resource := range tree.Resources {
+			if resource.Failed != nil && *resource.Failed || resource.Canceled != nil && *resource.Canceled {
+				continue
+			}
+
+			content, err := resourceContent(ctx, client, tree.Frame.ID, resource.URL)
+			if err != nil {
+				log.Printf("Unable to archive the resource %s: %v", resource.URL, err)
+				continue
+			}
+			if err := writeMHTMLPart(archive, resource.URL, resource.MimeType, content); err != nil {
+				return err
+			}
+		}
+
+		for i := range tree.ChildFrames {
+			if err := walk(&tree.ChildFrames[i], false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(&tree.FrameTree, true); err != nil {
+		return nil, err
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, errors.Wrap(err, "unable to finish the web archive")
+	}
+	return buf.Bytes(), nil
+}
+
+func resourceContent(ctx context.Context, client *cdp.Client, frameID page.FrameID, url string) ([]byte, error) {
+	reply, err := client.Page.GetResourceContent(ctx, &page.GetResourceContentArgs{
+		FrameID: frameID,
+		URL:     url,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if reply.Base64Encoded {
+		return base64.StdEncoding.DecodeString(reply.Content)
+	}
+	return []byte(reply.Content), nil
+}
+
+func writeMHTMLPart(archive *multipart.Writer, location, contentType string, content []byte) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "base64")
+	header.Set("Content-Location", location)
+
+	w, err := archive.CreatePart(header)
+	if err != nil {
+		return errors.Wrap(err, "unable to add a part to the web archive")
+	}
+
+	// MIME limits the lines to 76 characters
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > 76 {
+		fmt.Fprintf(w, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	if _, err := fmt.Fprintf(w, "%s\r\n", encoded); err != nil {
+		return errors.Wrap(err, "unable to write a part of the web archive")
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package screenshot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/mafredri/cdp/protocol/network"
+	"github.com/pkg/errors"
+)
+
+// DefaultBlocklist is a small bundled list of common ad and tracker hosts.
+var DefaultBlocklist = []string{
+	"*://*.doubleclick.net/*",
+	"*://*.googlesyndication.com/*",
+	"*://*.googleadservices.com/*",
+	"*://*.google-analytics.com/*",
+	"*://*.googletagmanager.com/*",
+	"*://*.googletagservices.com/*",
+	"*://*.adnxs.com/*",
+	"*://*.adsrvr.org/*",
+	"*://*.advertising.com/*",
+	"*://*.amazon-adsystem.com/*",
+	"*://*.criteo.com/*",
+	"*://*.criteo.net/*",
+	"*://*.outbrain.com/*",
+	"*://*.taboola.com/*",
+	"*://*.scorecardresearch.com/*",
+	"*://*.quantserve.com/*",
+	"*://*.moatads.com/*",
+	"*://*.rubiconproject.com/*",
+	"*://*.pubmatic.com/*",
+	"*://*.openx.net/*",
+	"*://*.casalemedia.com/*",
+	"*://*.hotjar.com/*",
+	"*://*.mixpanel.com/*",
+	"*://*.segment.io/*",
+	"*://*.newrelic.com/*",
+	"*://*.nr-data.net/*",
+	"*://connect.facebook.net/*",
+	"*://*.facebook.com/tr*",
+	"*://*.ads-twitter.com/*",
+	"*://*.yandex.ru/metrika/*",
+	"*://mc.yandex.ru/*",
+}
+
+// Blocklist matches request URLs against wildcard patterns, using the same
+// syntax as Chrome's request interception ('*' matches zero or more
+// characters, '?' exactly one and a backslash escapes the next character).
+type Blocklist struct {
+	patterns []*regexp.Regexp
+}
+
+func NewBlocklist(patterns []string) (*Blocklist, error) {
+	blocklist := &Blocklist{}
+	for _, pattern := range patterns {
+		re, err := compilePattern(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %q", pattern)
+		}
+		blocklist.patterns = append(blocklist.patterns, re)
+	}
+	return blocklist, nil
+}
+
+// LoadBlocklist reads patterns from a file, one per line. Empty lines and
+// lines starting with # are ignored.
+func LoadBlocklist(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open the blocklist")
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to read the blocklist")
+	}
+
+	return patterns, nil
+}
+
+func (b *Blocklist) Match(url string) bool {
+	for _, re := range b.patterns {
+		if re.MatchString(url) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter is a RequestFilter aborting every matching request.
+func (b *Blocklist) Filter(ctx context.Context, req *network.RequestInterceptedReply) network.ErrorReason {
+	if b.Match(req.Request.URL) {
+		return network.ErrorReasonAborted
+	}
+	return network.ErrorReasonNotSet
+}
+
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	var (
+		expr    bytes.Buffer
+		escaped bool
+	)
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '*':
+			expr.WriteString(".*")
+		case r == '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
@@ -0,0 +1,87 @@
+package screenshot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mafredri/cdp/protocol/network"
+)
+
+func TestCompilePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		url     string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "http://example.com/", true},
+		{"http://example.com/", "http://example.com/", true},
+		{"http://example.com/", "http://example.com/ad.js", false},
+		{"http://example.com/", "https://example.com/", false},
+
+		// '*' matches zero or more characters
+		{"*://ads.example.com/*", "https://ads.example.com/", true},
+		{"*://ads.example.com/*", "http://ads.example.com/banner.gif?x=1", true},
+		{"*://ads.example.com/*", "http://notads.example.com/", false},
+		{"*.doubleclick.net/*", "https://stats.g.doubleclick.net/collect", true},
+
+		// '?' matches exactly one
+		{"http://example.com/ad?.js", "http://example.com/ad1.js", true},
+		{"http://example.com/ad?.js", "http://example.com/ad.js", false},
+		{"http://example.com/ad?.js", "http://example.com/ad12.js", false},
+
+		// a backslash escapes the next character
+		{`http://example.com/\*`, "http://example.com/*", true},
+		{`http://example.com/\*`, "http://example.com/ad.js", false},
+		{`http://example.com/a\?`, "http://example.com/a?", true},
+		{`http://example.com/a\?`, "http://example.com/ab", false},
+		{`http://example.com/\\*`, `http://example.com/\ad.js`, true},
+
+		// the regexp metacharacters are literal
+		{"http://example.com/a.js", "http://example.com/abjs", false},
+		{"http://example.com/(ad)+[0-9]", "http://example.com/(ad)+[0-9]", true},
+		{"http://example.com/(ad)+[0-9]", "http://example.com/adad1", false},
+		{"^http://example.com/$", "^http://example.com/$", true},
+	}
+	for _, test := range tests {
+		re, err := compilePattern(test.pattern)
+		if err != nil {
+			t.Errorf("compilePattern(%q) = %v", test.pattern, err)
+			continue
+		}
+		if match := re.MatchString(test.url); match != test.match {
+			t.Errorf("compilePattern(%q) matches %q = %v, expected %v", test.pattern, test.url, match, test.match)
+		}
+	}
+}
+
+func TestBlocklistFilter(t *testing.T) {
+	blocklist, err := NewBlocklist([]string{"*://ads.example.com/*", "*/pixel.gif?*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url    string
+		reason network.ErrorReason
+	}{
+		{"https://ads.example.com/banner.js", network.ErrorReasonAborted},
+		{"https://example.com/pixel.gif?id=1", network.ErrorReasonAborted},
+		{"https://example.com/pixel.gif", network.ErrorReasonNotSet},
+		{"https://example.com/", network.ErrorReasonNotSet},
+	}
+	for _, test := range tests {
+		req := &network.RequestInterceptedReply{
+			Request: network.Request{URL: test.url},
+		}
+		if reason := blocklist.Filter(context.Background(), req); reason != test.reason {
+			t.Errorf("Filter(%q) = %q, expected %q", test.url, reason, test.reason)
+		}
+	}
+}
+
+func TestDefaultBlocklist(t *testing.T) {
+	if _, err := NewBlocklist(DefaultBlocklist); err != nil {
+		t.Fatal(err)
+	}
+}
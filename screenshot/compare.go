@@ -0,0 +1,202 @@
+package screenshot
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+
+	"github.com/pkg/errors"
+)
+
+// Comparison configures a visual regression check of the capture against
+// a baseline image.
+type Comparison struct {
+	Baseline           []byte   // png or jpeg
+	Threshold          float64  // maximum percentage of mismatched pixels that still passes
+	Tolerance          int      // per channel difference ignored as noise, 0-255
+	IgnoreAntialiasing bool     // ignore pixels matching a neighbour in the other image
+	IgnoreRegions      []Region // areas excluded from the comparison
+}
+
+// Region is a rectangle in image pixels.
+type Region struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// ComparisonResult is the outcome of a comparison.
+type ComparisonResult struct {
+	MismatchedPixels int     `json:"mismatched_pixels"`
+	Mismatch         float64 `json:"mismatch"` // in percent
+	Passed           bool    `json:"passed"`
+}
+
+// maxComparisonPixels bounds the baseline and the diff image, which are
+// decoded and drawn in memory.
+const maxComparisonPixels = 25 * 1000 * 1000
+
+var (
+	diffChanged = color.RGBA{R: 255, A: 255}
+	diffIgnored = color.RGBA{R: 255, G: 255, A: 255}
+)
+
+// Compare compares the image against the baseline and returns a diff image in
+// which the changed pixels are red over a faded copy of the image. Images of
+// different sizes are compared over their union, with the pixels covered by
+// only one of them counting as mismatched.
+func Compare(actual, baseline image.Image, c *Comparison) (*ComparisonResult, *image.RGBA) {
+	ab, bb := actual.Bounds(), baseline.Bounds()
+	width, height := maxInt(ab.Dx(), bb.Dx()), maxInt(ab.Dy(), bb.Dy())
+
+	diff := image.NewRGBA(image.Rect(0, 0, width, height))
+	var ignored []image.Rectangle
+	for _, r := range c.IgnoreRegions {
+		ignored = append(ignored, image.Rect(r.X, r.Y, r.X+r.Width, r.Y+r.Height))
+	}
+
+	mismatched := 0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := image.Pt(x, y)
+			inActual := p.In(image.Rect(0, 0, ab.Dx(), ab.Dy()))
+			inBaseline := p.In(image.Rect(0, 0, bb.Dx(), bb.Dy()))
+
+			var faded color.Color = color.White
+			if inActual {
+				faded = fade(actual.At(ab.Min.X+x, ab.Min.Y+y))
+			}
+			diff.Set(x, y, faded)
+
+			if inRegions(p, ignored) {
+				diff.Set(x, y, blend(faded, diffIgnored, 0.25))
+				continue
+			}
+
+			if inActual && inBaseline {
+				a := actual.At(ab.Min.X+x, ab.Min.Y+y)
+				b := baseline.At(bb.Min.X+x, bb.Min.Y+y)
+				if similar(a, b, c.Tolerance) {
+					continue
+				}
+				if c.IgnoreAntialiasing &&
+					(hasSimilarNeighbour(baseline, bb.Min.X+x, bb.Min.Y+y, a, c.Tolerance) ||
+						hasSimilarNeighbour(actual, ab.Min.X+x, ab.Min.Y+y, b, c.Tolerance)) {
+					continue
+				}
+			}
+
+			mismatched++
+			diff.Set(x, y, diffChanged)
+		}
+	}
+
+	result := &ComparisonResult{
+		MismatchedPixels: mismatched,
+	}
+	if total := width * height; total > 0 {
+		result.Mismatch = float64(mismatched) * 100 / float64(total)
+	}
+	result.Passed = result.Mismatch <= c.Threshold
+
+	return result, diff
+}
+
+// compareCapture decodes the baseline, compares the captured image with it
+// and returns the result along with the png encoded diff image. The size of
+// the baseline is checked before it's decoded.
+func compareCapture(actual image.Image, c *Comparison) (*ComparisonResult, []byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(c.Baseline))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to parse the baseline")
+	}
+	ab := actual.Bounds()
+	width, height := maxInt(ab.Dx(), config.Width), maxInt(ab.Dy(), config.Height)
+	if config.Width*config.Height > maxComparisonPixels || width*height > maxComparisonPixels {
+		return nil, nil, errors.Errorf("the baseline of %dx%d pixels is too large to compare with the capture of %dx%d pixels, the limit is %d pixels",
+			config.Width, config.Height, ab.Dx(), ab.Dy(), maxComparisonPixels)
+	}
+
+	baseline, _, err := image.Decode(bytes.NewReader(c.Baseline))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to parse the baseline")
+	}
+
+	result, diff := Compare(actual, baseline, c)
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, diff); err != nil {
+		return nil, nil, errors.Wrap(err, "unable to encode the diff image")
+	}
+	return result, buf.Bytes(), nil
+}
+
+func similar(a, b color.Color, tolerance int) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	t := uint32(tolerance) * 0x101
+	return absDiff(ar, br) <= t && absDiff(ag, bg) <= t && absDiff(ab, bb) <= t && absDiff(aa, ba) <= t
+}
+
+// hasSimilarNeighbour reports whether any pixel around x, y in img is similar
+// to c, which is how anti-aliased edges shifted by a pixel look.
+func hasSimilarNeighbour(img image.Image, x, y int, c color.Color, tolerance int) bool {
+	bounds := img.Bounds()
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			p := image.Pt(x+dx, y+dy)
+			if (dx == 0 && dy == 0) || !p.In(bounds) {
+				continue
+			}
+			if similar(img.At(p.X, p.Y), c, tolerance) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func inRegions(p image.Point, regions []image.Rectangle) bool {
+	for _, r := range regions {
+		if p.In(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// fade turns the color into a light gray, so that the changes stand out.
+func fade(c color.Color) color.Color {
+	gray := color.GrayModel.Convert(c).(color.Gray)
+	return color.Gray{Y: 192 + gray.Y/4}
+}
+
+// blend mixes the given share of over into base.
+func blend(base color.Color, over color.RGBA, share float64) color.Color {
+	b := color.RGBAModel.Convert(base).(color.RGBA)
+	mix := func(a, b uint8) uint8 {
+		return uint8(float64(a)*(1-share) + float64(b)*share)
+	}
+	return color.RGBA{
+		R: mix(b.R, over.R),
+		G: mix(b.G, over.G),
+		B: mix(b.B, over.B),
+		A: 255,
+	}
+}
+
+func absDiff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,162 @@
+package screenshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// filledImage returns a width x height image of the color, with the points
+// painted in the other color.
+func filledImage(width, height int, c color.RGBA, points map[image.Point]color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+	for p, c := range points {
+		img.SetRGBA(p.X, p.Y, c)
+	}
+	return img
+}
+
+func TestCompare(t *testing.T) {
+	var (
+		white = color.RGBA{255, 255, 255, 255}
+		black = color.RGBA{0, 0, 0, 255}
+		near  = color.RGBA{250, 250, 250, 255}
+	)
+	baseline := filledImage(10, 10, white, map[image.Point]color.RGBA{{4, 4}: black})
+
+	tests := []struct {
+		name       string
+		actual     image.Image
+		comparison Comparison
+		mismatched int
+		mismatch   float64
+		passed     bool
+	}{
+		{"identical", baseline, Comparison{}, 0, 0, true},
+		{"one pixel", filledImage(10, 10, white, nil), Comparison{}, 1, 1, false},
+		{"one pixel under the threshold", filledImage(10, 10, white, nil), Comparison{Threshold: 1}, 1, 1, true},
+		{"one pixel over the threshold", filledImage(10, 10, white, nil), Comparison{Threshold: 0.99}, 1, 1, false},
+		{
+			"within the tolerance",
+			filledImage(10, 10, near, map[image.Point]color.RGBA{{4, 4}: black}),
+			Comparison{Tolerance: 5}, 0, 0, true,
+		},
+		{
+			"over the tolerance",
+			filledImage(10, 10, near, map[image.Point]color.RGBA{{4, 4}: black}),
+			Comparison{Tolerance: 4}, 99, 99, false,
+		},
+		{
+			"ignored region",
+			filledImage(10, 10, white, nil),
+			Comparison{IgnoreRegions: []Region{{X: 3, Y: 3, Width: 2, Height: 2}}}, 0, 0, true,
+		},
+		{
+			"region next to the change",
+			filledImage(10, 10, white, nil),
+			Comparison{IgnoreRegions: []Region{{X: 5, Y: 5, Width: 2, Height: 2}}}, 1, 1, false,
+		},
+		{
+			"shifted by a pixel",
+			filledImage(10, 10, white, map[image.Point]color.RGBA{{5, 4}: black}),
+			Comparison{}, 2, 2, false,
+		},
+		{
+			"shifted by a pixel ignoring antialiasing",
+			filledImage(10, 10, white, map[image.Point]color.RGBA{{5, 4}: black}),
+			Comparison{IgnoreAntialiasing: true}, 0, 0, true,
+		},
+
+		// the pixels covered by only one of the images are mismatched
+		{"shorter", filledImage(10, 5, white, nil), Comparison{}, 51, 51, false},
+		{"taller", filledImage(10, 20, white, map[image.Point]color.RGBA{{4, 4}: black}), Comparison{}, 100, 50, false},
+		{"narrower and taller", filledImage(5, 20, white, map[image.Point]color.RGBA{{4, 4}: black}), Comparison{Threshold: 75}, 150, 75, true},
+	}
+	for _, test := range tests {
+		result, diff := Compare(test.actual, baseline, &test.comparison)
+		if result.MismatchedPixels != test.mismatched || result.Mismatch != test.mismatch || result.Passed != test.passed {
+			t.Errorf("%s: Compare() = %+v, expected %d pixels, %v%% and passed %v",
+				test.name, *result, test.mismatched, test.mismatch, test.passed)
+		}
+
+		ab := test.actual.Bounds()
+		want := image.Rect(0, 0, maxInt(ab.Dx(), 10), maxInt(ab.Dy(), 10))
+		if diff.Bounds() != want {
+			t.Errorf("%s: the diff image is %v, expected %v", test.name, diff.Bounds(), want)
+		}
+	}
+}
+
+// sizedImage is an image of any size which is never drawn.
+type sizedImage struct {
+	image.Image
+	bounds image.Rectangle
+}
+
+func (img sizedImage) Bounds() image.Rectangle {
+	return img.bounds
+}
+
+// pngHeader returns a png which claims to be width x height pixels, enough
+// for image.DecodeConfig.
+func pngHeader(t *testing.T, width, height int) []byte {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[16:20], uint32(width))
+	binary.BigEndian.PutUint32(data[20:24], uint32(height))
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestCompareCapture(t *testing.T) {
+	white := color.RGBA{255, 255, 255, 255}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, filledImage(10, 10, white, nil)); err != nil {
+		t.Fatal(err)
+	}
+	baseline := buf.Bytes()
+
+	tests := []struct {
+		name     string
+		actual   image.Image
+		baseline []byte
+		err      string
+	}{
+		{"same size", filledImage(10, 10, white, nil), baseline, ""},
+		{"different size", filledImage(20, 5, white, nil), baseline, ""},
+		{"invalid baseline", filledImage(10, 10, white, nil), []byte("not an image"), "unable to parse the baseline"},
+		{"baseline too large", filledImage(10, 10, white, nil), pngHeader(t, 5001, 5000), "too large to compare"},
+		{"capture too large", sizedImage{bounds: image.Rect(0, 0, 5001, 5000)}, baseline, "too large to compare"},
+		{"union too large", sizedImage{bounds: image.Rect(0, 0, 5001, 10)}, pngHeader(t, 10, 5000), "too large to compare"},
+	}
+	for _, test := range tests {
+		c := &Comparison{Baseline: test.baseline}
+		result, diff, err := compareCapture(test.actual, c)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: compareCapture() = %v, expected an error containing %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: compareCapture() = %v", test.name, err)
+			continue
+		}
+		if result == nil || len(diff) == 0 {
+			t.Errorf("%s: compareCapture() returned no result or diff", test.name)
+		}
+	}
+}
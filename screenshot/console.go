@@ -0,0 +1,325 @@
+package screenshot
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/mafredri/cdp"
+	"github.com/mafredri/cdp/protocol/network"
+	"github.com/mafredri/cdp/protocol/runtime"
+	"github.com/pkg/errors"
+)
+
+// Default bounds of a ConsoleLog.
+const (
+	DefaultMaxConsoleEntries = 100
+	DefaultMaxConsoleLength  = 1024
+)
+
+// ConsoleLog is what the page reported while it was captured.
+type ConsoleLog struct {
+	Messages       []ConsoleMessage `json:"messages,omitempty"`
+	Exceptions     []PageException  `json:"exceptions,omitempty"`
+	FailedRequests []FailedRequest  `json:"failed_requests,omitempty"`
+	Dropped        int              `json:"dropped,omitempty"` // entries over the limit
+}
+
+// ConsoleMessage is a call of the console API or an entry of the browser log.
+type ConsoleMessage struct {
+	Source string `json:"source"` // console, network, security, ...
+	Level  string `json:"level"`  // log, info, warning, error, ...
+	Text   string `json:"text"`
+	URL    string `json:"url,omitempty"`
+	Line   int    `json:"line,omitempty"`
+}
+
+// PageException is an uncaught JavaScript exception.
+type PageException struct {
+	Text   string `json:"text"`
+	URL    string `json:"url,omitempty"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+}
+
+// FailedRequest is a request which failed to load or got an error response.
+type FailedRequest struct {
+	URL    string `json:"url"`
+	Type   string `json:"type,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// consoleCollector records the console, exception and network failure
+// events of a page until it's closed.
+type consoleCollector struct {
+	maxEntries int
+	maxLength  int
+
+	mu       sync.Mutex
+	log      ConsoleLog
+	requests map[network.RequestID]string
+
+	listeners
+}
+
+// collectConsole subscribes to the events and enables the Runtime, Log and
+// Network domains, so it should be called before navigating.
+func collectConsole(ctx context.Context, client *cdp.Client, maxEntries, maxLength int) (*consoleCollector, error) {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxConsoleEntries
+	}
+	if maxLength <= 0 {
+		maxLength = DefaultMaxConsoleLength
+	}
+
+	c := &consoleCollector{
+		maxEntries: maxEntries,
+		maxLength:  maxLength,
+		requests:   map[network.RequestID]string{},
+	}
+
+	consoleAPI, err := client.Runtime.ConsoleAPICalled(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to setup a listener to ConsoleAPICalled")
+	}
+	c.listen(consoleAPI, func() error {
+		ev, err := consoleAPI.Recv()
+		if err != nil {
+			return err
+		}
+		msg := ConsoleMessage{
+			Source: "console",
+			Level:  ev.Type,
+			Text:   formatArgs(ev.Args),
+		}
+		if ev.StackTrace != nil && len(ev.StackTrace.CallFrames) > 0 {
+			msg.URL = ev.StackTrace.CallFrames[0].URL
+			msg.Line = ev.StackTrace.CallFrames[0].LineNumber + 1
+		}
+		c.addMessage(msg)
+		return nil
+	})
+
+	exceptions, err := client.Runtime.ExceptionThrown(ctx)
+	if err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "unable to setup a listener to ExceptionThrown")
+	}
+	c.listen(exceptions, func() error {
+		ev, err := exceptions.Recv()
+		if err != nil {
+			return err
+		}
+		details := ev.ExceptionDetails
+		exception := PageException{
+			Text:   details.Text,
+			Line:   details.LineNumber + 1,
+			Column: details.ColumnNumber + 1,
+		}
+		if details.Exception != nil && details.Exception.Description != nil {
+			exception.Text = details.Text + " " + *details.Exception.Description
+		}
+		if details.URL != nil {
+			exception.URL = *details.URL
+		}
+		c.addException(exception)
+		return nil
+	})
+
+	entries, err := client.Log.EntryAdded(ctx)
+	if err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "unable to setup a listener to EntryAdded")
+	}
+	c.listen(entries, func() error {
+		ev, err := entries.Recv()
+		if err != nil {
+			return err
+		}
+		msg := ConsoleMessage{
+			Source: ev.Entry.Source,
+			Level:  ev.Entry.Level,
+			Text:   ev.Entry.Text,
+		}
+		if ev.Entry.URL != nil {
+			msg.URL = *ev.Entry.URL
+		}
+		if ev.Entry.LineNumber != nil {
+			msg.Line = *ev.Entry.LineNumber + 1
+		}
+		c.addMessage(msg)
+		return nil
+	})
+
+	// Failures only carry the request ID, so remember the URLs
+	requests, err := client.Network.RequestWillBeSent(ctx)
+	if err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "unable to setup a listener to RequestWillBeSent")
+	}
+	c.listen(requests, func() error {
+		ev, err := requests.Recv()
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.requests[ev.RequestID] = ev.Request.URL
+		c.mu.Unlock()
+		return nil
+	})
+
+	responses, err := client.Network.ResponseReceived(ctx)
+	if err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "unable to setup a listener to ResponseReceived")
+	}
+	c.listen(responses, func() error {
+		ev, err := responses.Recv()
+		if err != nil {
+			return err
+		}
+		if ev.Response.Status >= 400 {
+			c.addFailedRequest(FailedRequest{
+				URL:    ev.Response.URL,
+				Type:   string(ev.Type),
+				Status: ev.Response.Status,
+				Error:  ev.Response.StatusText,
+			})
+		}
+		return nil
+	})
+
+	failures, err := client.Network.LoadingFailed(ctx)
+	if err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "unable to setup a listener to LoadingFailed")
+	}
+	c.listen(failures, func() error {
+		ev, err := failures.Recv()
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		url := c.requests[ev.RequestID]
+		c.mu.Unlock()
+
+		failure := FailedRequest{
+			URL:   url,
+			Type:  string(ev.Type),
+			Error: ev.ErrorText,
+		}
+		if ev.BlockedReason != "" {
+			failure.Error += " (" + string(ev.BlockedReason) + ")"
+		}
+		c.addFailedRequest(failure)
+		return nil
+	})
+
+	if err := client.Runtime.Enable(ctx); err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "unable to enable the Runtime domain")
+	}
+	if err := client.Log.Enable(ctx); err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "unable to enable the Log domain")
+	}
+	if err := client.Network.Enable(ctx, network.NewEnableArgs()); err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "unable to enable the Network domain")
+	}
+
+	return c, nil
+}
+
+func (c *consoleCollector) addMessage(msg ConsoleMessage) {
+	msg.Text = c.truncate(msg.Text)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.log.Messages) >= c.maxEntries {
+		c.log.Dropped++
+		return
+	}
+	c.log.Messages = append(c.log.Messages, msg)
+}
+
+func (c *consoleCollector) addException(exception PageException) {
+	exception.Text = c.truncate(exception.Text)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.log.Exceptions) >= c.maxEntries {
+		c.log.Dropped++
+		return
+	}
+	c.log.Exceptions = append(c.log.Exceptions, exception)
+}
+
+func (c *consoleCollector) addFailedRequest(failure FailedRequest) {
+	failure.URL = c.truncate(failure.URL)
+	failure.Error = c.truncate(failure.Error)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.log.FailedRequests) >= c.maxEntries {
+		c.log.Dropped++
+		return
+	}
+	c.log.FailedRequests = append(c.log.FailedRequests, failure)
+}
+
+func (c *consoleCollector) truncate(text string) string {
+	if len(text) <= c.maxLength {
+		return text
+	}
+	// Don't cut a multi-byte character in half
+	n := c.maxLength
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return text[:n] + "…"
+}
+
+// Log returns a copy of what was collected so far, nil if nothing was.
+func (c *consoleCollector) Log() *ConsoleLog {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.log.Messages) == 0 && len(c.log.Exceptions) == 0 &&
+		len(c.log.FailedRequests) == 0 && c.log.Dropped == 0 {
+		return nil
+	}
+	log := c.log
+	return &log
+}
+
+// Close stops listening to the events.
+func (c *consoleCollector) Close() {
+	c.close()
+}
+
+// formatArgs joins the arguments of a console call like the devtools do.
+func formatArgs(args []runtime.RemoteObject) string {
+	parts := make([]string, 0, len(args))
+	for _, arg := range args {
+		switch {
+		case len(arg.Value) > 0:
+			var s string
+			if err := json.Unmarshal(arg.Value, &s); err == nil {
+				parts = append(parts, s)
+			} else {
+				parts = append(parts, string(arg.Value))
+			}
+		case arg.UnserializableValue != "":
+			parts = append(parts, string(arg.UnserializableValue))
+		case arg.Description != nil:
+			parts = append(parts, *arg.Description)
+		default:
+			parts = append(parts, arg.Type)
+		}
+	}
+	return strings.Join(parts, " ")
+}
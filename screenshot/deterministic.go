@@ -0,0 +1,150 @@
+package screenshot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mafredri/cdp"
+	"github.com/mafredri/cdp/protocol/emulation"
+	"github.com/mafredri/cdp/protocol/page"
+	"github.com/pkg/errors"
+)
+
+// Deterministic makes repeated captures of the same page identical. The CSS
+// animations and transitions are disabled and the text caret is hidden.
+type Deterministic struct {
+	VirtualTimeBudget time.Duration // runs the page in virtual time for this long, real time if 0
+	Seed              *int64        // seeds Math.random when set
+	Clock             time.Time     // stops Date at this time when set
+}
+
+// freezeStyle disables the animations, transitions and the blinking caret.
+const freezeStyle = `*, *::before, *::after {
+	animation: none !important;
+	transition: none !important;
+	caret-color: transparent !important;
+}`
+
+// freezeScript installs freezeStyle into the document once it exists. It's
+// safe to run more than once.
+var freezeScript = fmt.Sprintf(`(function() {
+	var install = function() {
+		if (!document.documentElement || document.getElementById('__cdp_screenshots_freeze')) {
+			return;
+		}
+		var style = document.createElement('style');
+		style.id = '__cdp_screenshots_freeze';
+		style.textContent = %q;
+		(document.head || document.documentElement).appendChild(style);
+	};
+	install();
+	document.addEventListener('DOMContentLoaded', install);
+})()`, freezeStyle)
+
+// seedScript replaces Math.random with a seeded mulberry32 generator.
+const seedScript = `(function(seed) {
+	Math.random = function() {
+		seed = (seed + 0x6D2B79F5) | 0;
+		var t = Math.imul(seed ^ (seed >>> 15), 1 | seed);
+		t = (t + Math.imul(t ^ (t >>> 7), 61 | t)) ^ t;
+		return ((t ^ (t >>> 14)) >>> 0) / 4294967296;
+	};
+})(%d)`
+
+// clockScript stops Date at the given time in ms since the epoch. Explicit
+// dates still work.
+const clockScript = `(function(now) {
+	var NativeDate = Date;
+	var FixedDate = function() {
+		var args = Array.prototype.slice.call(arguments);
+		if (!(this instanceof FixedDate)) {
+			return new NativeDate(now).toString();
+		}
+		if (args.length === 0) {
+			return new NativeDate(now);
+		}
+		return new (Function.prototype.bind.apply(NativeDate, [null].concat(args)))();
+	};
+	FixedDate.prototype = NativeDate.prototype;
+	FixedDate.now = function() { return now; };
+	FixedDate.parse = NativeDate.parse;
+	FixedDate.UTC = NativeDate.UTC;
+	Date = FixedDate;
+})(%d)`
+
+// determinism holds the state of the deterministic mode between the setup
+// before the navigation and the wait after it.
+type determinism struct {
+	budgetExpired emulation.VirtualTimeBudgetExpiredClient
+}
+
+// prepareDeterministic injects the scripts into every new document and starts
+// the virtual time. Call it before navigating.
+func prepareDeterministic(ctx context.Context, client *cdp.Client, det *Deterministic) (*determinism, error) {
+	scripts := []string{freezeScript}
+	if det.Seed != nil {
+		scripts = append(scripts, fmt.Sprintf(seedScript, *det.Seed))
+	}
+	if !det.Clock.IsZero() {
+		scripts = append(scripts, fmt.Sprintf(clockScript, det.Clock.UnixNano()/int64(time.Millisecond)))
+	}
+	for _, script := range scripts {
+		if _, err := client.Page.AddScriptToEvaluateOnNewDocument(ctx, page.NewAddScriptToEvaluateOnNewDocumentArgs(script)); err != nil {
+			return nil, errors.Wrap(err, "unable to inject the deterministic mode script")
+		}
+	}
+
+	d := &determinism{}
+	if det.VirtualTimeBudget > 0 {
+		var err error
+		d.budgetExpired, err = client.Emulation.VirtualTimeBudgetExpired(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to setup a listener to VirtualTimeBudgetExpired")
+		}
+
+		// Virtual time doesn't advance while the page is loading anything,
+		// so slow responses don't change the outcome.
+		args := emulation.NewSetVirtualTimePolicyArgs(emulation.VirtualTimePolicyPauseIfNetworkFetchesPending).
+			SetBudget(int(det.VirtualTimeBudget / time.Millisecond))
+		if err := client.Emulation.SetVirtualTimePolicy(ctx, args); err != nil {
+			d.Close()
+			return nil, errors.Wrap(err, "unable to set the virtual time policy")
+		}
+	}
+
+	log.Print("Enabled the deterministic mode")
+
+	return d, nil
+}
+
+// wait waits for the virtual time budget to run out and makes sure that the
+// animations are frozen in the current document, which setDocumentContent
+// replaces without running the injected scripts. Virtual time is paused once
+// the budget runs out, so it's let advance again for the animation frames
+// and the timers the capture waits for.
+func (d *determinism) wait(ctx context.Context, client *cdp.Client) error {
+	if d.budgetExpired != nil {
+		if _, err := d.budgetExpired.Recv(); err != nil {
+			return errors.Wrap(err, "unable to wait for the virtual time budget")
+		}
+		log.Print("The virtual time budget expired")
+
+		args := emulation.NewSetVirtualTimePolicyArgs(emulation.VirtualTimePolicyAdvance)
+		if err := client.Emulation.SetVirtualTimePolicy(ctx, args); err != nil {
+			return errors.Wrap(err, "unable to resume the virtual time")
+		}
+	}
+
+	if err := evaluate(ctx, client, freezeScript, nil); err != nil {
+		return errors.Wrap(err, "unable to freeze the animations")
+	}
+	return nil
+}
+
+func (d *determinism) Close() {
+	if d.budgetExpired != nil {
+		d.budgetExpired.Close()
+	}
+}
@@ -0,0 +1,131 @@
+package screenshot
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/mafredri/cdp"
+	"github.com/mafredri/cdp/protocol/page"
+	"github.com/pkg/errors"
+)
+
+// Actions of a DialogPolicy.
+const (
+	DialogAccept  = "accept"
+	DialogDismiss = "dismiss"
+)
+
+// maxDialogs limits the number of dialogs recorded in a Result.
+const maxDialogs = 100
+
+// DialogPolicy decides how the JavaScript dialogs are resolved. The
+// beforeunload dialogs are always accepted, so that they can't keep a page
+// from closing.
+type DialogPolicy struct {
+	Action     string `json:"action"`      // accept or dismiss, accept by default
+	PromptText string `json:"prompt_text"` // entered into accepted prompts
+}
+
+// Dialog is a JavaScript dialog opened by the page.
+type Dialog struct {
+	Type       string `json:"type"` // alert, confirm, prompt or beforeunload
+	Message    string `json:"message"`
+	URL        string `json:"url"`
+	Accepted   bool   `json:"accepted"`
+	PromptText string `json:"prompt_text,omitempty"`
+}
+
+// Validate checks the action of the policy.
+func (p *DialogPolicy) Validate() error {
+	switch p.Action {
+	case "", DialogAccept, DialogDismiss:
+		return nil
+	}
+	return errors.Errorf("invalid dialog action %q", p.Action)
+}
+
+// DialogHandler resolves the JavaScript dialogs of a page as they open.
+type DialogHandler struct {
+	mu      sync.Mutex
+	dialogs []Dialog
+
+	done     chan struct{}
+	doneOnce sync.Once
+
+	listeners
+}
+
+// HandleDialogs resolves every dialog the page opens according to the policy
+// until the handler is closed. Page events need to be enabled.
+func HandleDialogs(ctx context.Context, client *cdp.Client, policy *DialogPolicy) (*DialogHandler, error) {
+	if policy == nil {
+		policy = &DialogPolicy{}
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+
+	opening, err := client.Page.JavascriptDialogOpening(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to setup a listener to JavascriptDialogOpening")
+	}
+
+	h := &DialogHandler{
+		done: make(chan struct{}),
+	}
+	h.listen(opening, func() error {
+		ev, err := opening.Recv()
+		if err != nil {
+			h.doneOnce.Do(func() { close(h.done) })
+			return err
+		}
+
+		dialog := Dialog{
+			Type:     string(ev.Type),
+			Message:  ev.Message,
+			URL:      ev.URL,
+			Accepted: policy.Action != DialogDismiss || ev.Type == page.DialogTypeBeforeunload,
+		}
+
+		args := page.NewHandleJavaScriptDialogArgs(dialog.Accepted)
+		if ev.Type == page.DialogTypePrompt && dialog.Accepted {
+			dialog.PromptText = policy.PromptText
+			if dialog.PromptText == "" && ev.DefaultPrompt != nil {
+				dialog.PromptText = *ev.DefaultPrompt
+			}
+			args = args.SetPromptText(dialog.PromptText)
+		}
+		if err := client.Page.HandleJavaScriptDialog(ctx, args); err != nil {
+			log.Printf("Unable to handle the %s dialog: %v", ev.Type, err)
+		} else {
+			log.Printf("Handled the %s dialog %q, accepted: %v", ev.Type, ev.Message, dialog.Accepted)
+		}
+
+		h.mu.Lock()
+		if len(h.dialogs) < maxDialogs {
+			h.dialogs = append(h.dialogs, dialog)
+		}
+		h.mu.Unlock()
+		return nil
+	})
+
+	return h, nil
+}
+
+// Dialogs returns the dialogs handled so far.
+func (h *DialogHandler) Dialogs() []Dialog {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Dialog(nil), h.dialogs...)
+}
+
+// Done is closed once the page is gone and no more dialogs can open.
+func (h *DialogHandler) Done() <-chan struct{} {
+	return h.done
+}
+
+// Close stops handling the dialogs.
+func (h *DialogHandler) Close() {
+	h.close()
+}
@@ -0,0 +1,36 @@
+package screenshot
+
+import (
+	"sync"
+
+	"github.com/mafredri/cdp/rpcc"
+)
+
+// listeners runs a receive loop for each of the event streams until they
+// are closed.
+type listeners struct {
+	streams []rpcc.Stream
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+// listen calls recv until it fails, which happens once the stream is closed.
+func (l *listeners) listen(stream rpcc.Stream, recv func() error) {
+	l.streams = append(l.streams, stream)
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		for recv() == nil {
+		}
+	}()
+}
+
+// close closes the streams and waits for the loops to return.
+func (l *listeners) close() {
+	l.once.Do(func() {
+		for _, stream := range l.streams {
+			stream.Close()
+		}
+		l.wg.Wait()
+	})
+}
@@ -0,0 +1,189 @@
+package screenshot
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+
+	"github.com/nfnt/resize"
+)
+
+// Fingerprint summarizes an image for deduplication and similarity search.
+// The hashes are 64-bit and hex encoded, compare them by Hamming distance.
+type Fingerprint struct {
+	AHash        string   `json:"ahash"`
+	DHash        string   `json:"dhash"`
+	PHash        string   `json:"phash"`
+	AverageColor string   `json:"average_color"` // #rrggbb
+	Palette      []string `json:"palette"`       // dominant colours, most common first
+}
+
+// paletteSize is the number of dominant colours in a Fingerprint.
+const paletteSize = 5
+
+func NewFingerprint(img image.Image) *Fingerprint {
+	return &Fingerprint{
+		AHash:        fmt.Sprintf("%016x", averageHash(img)),
+		DHash:        fmt.Sprintf("%016x", differenceHash(img)),
+		PHash:        fmt.Sprintf("%016x", perceptualHash(img)),
+		AverageColor: hexColor(averageColor(img)),
+		Palette:      dominantColors(img, paletteSize),
+	}
+}
+
+// averageHash sets a bit for every pixel of an 8x8 thumbnail brighter than
+// the mean.
+func averageHash(img image.Image) uint64 {
+	pixels := grayscale(img, 8, 8)
+
+	var mean float64
+	for _, p := range pixels {
+		mean += p
+	}
+	mean /= float64(len(pixels))
+
+	var hash uint64
+	for i, p := range pixels {
+		if p > mean {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// differenceHash sets a bit for every pixel of a 9x8 thumbnail darker than
+// its right neighbour.
+func differenceHash(img image.Image) uint64 {
+	pixels := grayscale(img, 9, 8)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if pixels[y*9+x] < pixels[y*9+x+1] {
+				hash |= 1 << uint(y*8+x)
+			}
+		}
+	}
+	return hash
+}
+
+// perceptualHash sets a bit for every low frequency of the DCT of a 32x32
+// thumbnail above the median.
+func perceptualHash(img image.Image) uint64 {
+	const size, lows = 32, 8
+	pixels := grayscale(img, size, size)
+
+	coeffs := make([]float64, 0, lows*lows)
+	for v := 0; v < lows; v++ {
+		for u := 0; u < lows; u++ {
+			var sum float64
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					sum += pixels[y*size+x] *
+						math.Cos(float64(2*x+1)*float64(u)*math.Pi/(2*size)) *
+						math.Cos(float64(2*y+1)*float64(v)*math.Pi/(2*size))
+				}
+			}
+			coeffs = append(coeffs, sum)
+		}
+	}
+
+	// The DC coefficient only tells the average brightness, leave it out
+	sorted := append([]float64(nil), coeffs[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash uint64
+	for i, c := range coeffs {
+		if c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+func grayscale(img image.Image, width, height int) []float64 {
+	thumb := resize.Resize(uint(width), uint(height), img, resize.Bilinear)
+	bounds := thumb.Bounds()
+
+	pixels := make([]float64, 0, width*height)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			pixels = append(pixels, float64(color.GrayModel.Convert(thumb.At(x, y)).(color.Gray).Y))
+		}
+	}
+	return pixels
+}
+
+func averageColor(img image.Image) color.RGBA {
+	thumb := resize.Resize(64, 0, img, resize.Bilinear)
+	bounds := thumb.Bounds()
+
+	var r, g, b, n uint64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.RGBAModel.Convert(thumb.At(x, y)).(color.RGBA)
+			r, g, b, n = r+uint64(c.R), g+uint64(c.G), b+uint64(c.B), n+1
+		}
+	}
+	if n == 0 {
+		return color.RGBA{A: 255}
+	}
+	return color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: 255}
+}
+
+// dominantColors buckets the pixels of a thumbnail by their top 3 bits per
+// channel and returns the average colours of the largest buckets.
+func dominantColors(img image.Image, count int) []string {
+	thumb := resize.Resize(64, 0, img, resize.Bilinear)
+	bounds := thumb.Bounds()
+
+	type bucket struct {
+		key        uint32
+		r, g, b, n uint64
+	}
+	buckets := map[uint32]*bucket{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.RGBAModel.Convert(thumb.At(x, y)).(color.RGBA)
+			key := uint32(c.R>>5)<<6 | uint32(c.G>>5)<<3 | uint32(c.B>>5)
+			bk, ok := buckets[key]
+			if !ok {
+				bk = &bucket{key: key}
+				buckets[key] = bk
+			}
+			bk.r, bk.g, bk.b, bk.n = bk.r+uint64(c.R), bk.g+uint64(c.G), bk.b+uint64(c.B), bk.n+1
+		}
+	}
+
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, bk := range buckets {
+		sorted = append(sorted, bk)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].n != sorted[j].n {
+			return sorted[i].n > sorted[j].n
+		}
+		return sorted[i].key < sorted[j].key
+	})
+
+	var palette []string
+	for _, bk := range sorted {
+		if len(palette) == count {
+			break
+		}
+		palette = append(palette, hexColor(color.RGBA{
+			R: uint8(bk.r / bk.n),
+			G: uint8(bk.g / bk.n),
+			B: uint8(bk.b / bk.n),
+			A: 255,
+		}))
+	}
+	return palette
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
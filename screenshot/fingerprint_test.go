@@ -0,0 +1,153 @@
+package screenshot
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math/bits"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// pageImage draws a page like picture at the scale: a header bar, a block
+// of content and a gradient background.
+func pageImage(scale int, inverted bool) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 160*scale, 100*scale))
+	for y := 0; y < 100*scale; y++ {
+		for x := 0; x < 160*scale; x++ {
+			px, py := x/scale, y/scale
+			c := color.NRGBA{R: uint8(px), G: uint8(py * 2), B: 200, A: 255}
+			switch {
+			case py < 15:
+				c = color.NRGBA{R: 30, G: 60, B: 120, A: 255}
+			case px > 20 && px < 100 && py > 30 && py < 80:
+				c = color.NRGBA{R: 250, G: 250, B: 250, A: 255}
+			}
+			if inverted {
+				c.R, c.G, c.B = 255-c.R, 255-c.G, 255-c.B
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func hashDistance(t *testing.T, a, b string) int {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bits.OnesCount64(x ^ y)
+}
+
+func TestFingerprintStable(t *testing.T) {
+	img := pageImage(1, false)
+	want := NewFingerprint(img)
+
+	// The same pixels in another representation, eg. after a png round trip
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	framed := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx()+20, img.Bounds().Dy()+20))
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			rgba.Set(x, y, img.At(x, y))
+			framed.Set(x+10, y+10, img.At(x, y))
+		}
+	}
+
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{"again", img},
+		{"png round trip", decoded},
+		{"rgba", rgba},
+		{"offset bounds", framed.SubImage(img.Bounds().Add(image.Pt(10, 10)))},
+	}
+	for _, test := range tests {
+		for i := 0; i < 3; i++ {
+			if got := NewFingerprint(test.img); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: NewFingerprint() = %+v, expected %+v", test.name, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestFingerprintDistance(t *testing.T) {
+	original := NewFingerprint(pageImage(1, false))
+
+	tests := []struct {
+		name     string
+		img      image.Image
+		min, max int
+	}{
+		{"twice the size", pageImage(2, false), 0, 6},
+		{"inverted", pageImage(1, true), 24, 64},
+	}
+	for _, test := range tests {
+		fp := NewFingerprint(test.img)
+		for _, hash := range []struct{ name, a, b string }{
+			{"ahash", original.AHash, fp.AHash},
+			{"dhash", original.DHash, fp.DHash},
+			{"phash", original.PHash, fp.PHash},
+		} {
+			if d := hashDistance(t, hash.a, hash.b); d < test.min || d > test.max {
+				t.Errorf("%s: the %s distance is %d, expected %d to %d", test.name, hash.name, d, test.min, test.max)
+			}
+		}
+	}
+}
+
+func TestFingerprintColors(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= 75 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	fp := NewFingerprint(img)
+	if len(fp.Palette) < 2 || !nearColor(t, fp.Palette[0], color.RGBA{R: 255}) || !nearColor(t, fp.Palette[1], color.RGBA{B: 255}) {
+		t.Errorf("Palette = %q, expected red and blue first", fp.Palette)
+	}
+	if !nearColor(t, fp.AverageColor, color.RGBA{R: 191, B: 64}) {
+		t.Errorf("AverageColor = %s, expected about #bf0040", fp.AverageColor)
+	}
+}
+
+// nearColor reports whether the #rrggbb color is within 4 per channel of c,
+// which the resizing blurs the edges by.
+func nearColor(t *testing.T, hex string, c color.RGBA) bool {
+	v, err := strconv.ParseUint(hex[1:], 16, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, channel := range []struct{ got, want uint8 }{
+		{uint8(v >> 16), c.R},
+		{uint8(v >> 8), c.G},
+		{uint8(v), c.B},
+	} {
+		if d := int(channel.got) - int(channel.want); d < -4 || d > 4 {
+			return false
+		}
+	}
+	return true
+}
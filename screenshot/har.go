@@ -0,0 +1,547 @@
+package screenshot
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mafredri/cdp"
+	"github.com/mafredri/cdp/protocol/network"
+	"github.com/pkg/errors"
+)
+
+// HAR is an HTTP Archive 1.2 document, see
+// http://www.softwareishard.com/blog/har-12-spec/
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Pages   []HARPage  `json:"pages"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HARPage struct {
+	StartedDateTime string         `json:"startedDateTime"`
+	ID              string         `json:"id"`
+	Title           string         `json:"title"`
+	PageTimings     HARPageTimings `json:"pageTimings"`
+}
+
+// HARPageTimings are in milliseconds since the start of the page, -1 when
+// the event didn't happen.
+type HARPageTimings struct {
+	OnContentLoad float64 `json:"onContentLoad"`
+	OnLoad        float64 `json:"onLoad"`
+}
+
+type HAREntry struct {
+	PageRef         string      `json:"pageref"`
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Error           string      `json:"_error,omitempty"` // why the request failed
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+// HARTimings are in milliseconds, -1 when the phase doesn't apply.
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// harPageID is the ID of the only page in the recorded HARs.
+const harPageID = "page_1"
+
+// harRecord is the state of a single request, redirects start a new one.
+type harRecord struct {
+	entry      HAREntry
+	start      network.MonotonicTime
+	responseAt network.MonotonicTime
+	end        network.MonotonicTime
+	timing     *network.ResourceTiming
+	headers    int // size of the raw response headers, if known
+}
+
+// HARRecorder records the network activity of a page into a HAR document.
+type HARRecorder struct {
+	mu        sync.Mutex
+	records   []*harRecord
+	pending   map[network.RequestID]*harRecord
+	page      HARPage
+	pageStart network.MonotonicTime
+
+	listeners
+}
+
+// NewHARRecorder subscribes to the network events of the page and enables
+// the Page and Network domains. Start it before navigating, so that the
+// document request is recorded too, and close it once done.
+func NewHARRecorder(ctx context.Context, client *cdp.Client) (*HARRecorder, error) {
+	r := &HARRecorder{
+		pending: map[network.RequestID]*harRecord{},
+		page: HARPage{
+			ID: harPageID,
+			PageTimings: HARPageTimings{
+				OnContentLoad: -1,
+				OnLoad:        -1,
+			},
+		},
+	}
+
+	requests, err := client.Network.RequestWillBeSent(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to setup a listener to RequestWillBeSent")
+	}
+	r.listen(requests, func() error {
+		ev, err := requests.Recv()
+		if err != nil {
+			return err
+		}
+		r.requestWillBeSent(ev)
+		return nil
+	})
+
+	responses, err := client.Network.ResponseReceived(ctx)
+	if err != nil {
+		r.Close()
+		return nil, errors.Wrap(err, "unable to setup a listener to ResponseReceived")
+	}
+	r.listen(responses, func() error {
+		ev, err := responses.Recv()
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		if rec, ok := r.pending[ev.RequestID]; ok {
+			rec.setResponse(&ev.Response)
+			rec.responseAt = ev.Timestamp
+		}
+		r.mu.Unlock()
+		return nil
+	})
+
+	data, err := client.Network.DataReceived(ctx)
+	if err != nil {
+		r.Close()
+		return nil, errors.Wrap(err, "unable to setup a listener to DataReceived")
+	}
+	r.listen(data, func() error {
+		ev, err := data.Recv()
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		if rec, ok := r.pending[ev.RequestID]; ok {
+			rec.entry.Response.Content.Size += ev.DataLength
+		}
+		r.mu.Unlock()
+		return nil
+	})
+
+	finished, err := client.Network.LoadingFinished(ctx)
+	if err != nil {
+		r.Close()
+		return nil, errors.Wrap(err, "unable to setup a listener to LoadingFinished")
+	}
+	r.listen(finished, func() error {
+		ev, err := finished.Recv()
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		if rec, ok := r.pending[ev.RequestID]; ok {
+			rec.entry.Response.BodySize = int(ev.EncodedDataLength) - rec.headers
+			rec.end = ev.Timestamp
+			delete(r.pending, ev.RequestID)
+		}
+		r.mu.Unlock()
+		return nil
+	})
+
+	failed, err := client.Network.LoadingFailed(ctx)
+	if err != nil {
+		r.Close()
+		return nil, errors.Wrap(err, "unable to setup a listener to LoadingFailed")
+	}
+	r.listen(failed, func() error {
+		ev, err := failed.Recv()
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		if rec, ok := r.pending[ev.RequestID]; ok {
+			rec.entry.Error = ev.ErrorText
+			rec.end = ev.Timestamp
+			delete(r.pending, ev.RequestID)
+		}
+		r.mu.Unlock()
+		return nil
+	})
+
+	domContent, err := client.Page.DOMContentEventFired(ctx)
+	if err != nil {
+		r.Close()
+		return nil, errors.Wrap(err, "unable to setup a listener to DOMContentEventFired")
+	}
+	r.listen(domContent, func() error {
+		ev, err := domContent.Recv()
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		if r.pageStart != 0 {
+			r.page.PageTimings.OnContentLoad = milliseconds(ev.Timestamp - r.pageStart)
+		}
+		r.mu.Unlock()
+		return nil
+	})
+
+	load, err := client.Page.LoadEventFired(ctx)
+	if err != nil {
+		r.Close()
+		return nil, errors.Wrap(err, "unable to setup a listener to LoadEventFired")
+	}
+	r.listen(load, func() error {
+		ev, err := load.Recv()
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		if r.pageStart != 0 {
+			r.page.PageTimings.OnLoad = milliseconds(ev.Timestamp - r.pageStart)
+		}
+		r.mu.Unlock()
+		return nil
+	})
+
+	if err := client.Page.Enable(ctx); err != nil {
+		r.Close()
+		return nil, errors.Wrap(err, "unable to enable the Page domain")
+	}
+	if err := client.Network.Enable(ctx, network.NewEnableArgs()); err != nil {
+		r.Close()
+		return nil, errors.Wrap(err, "unable to enable the Network domain")
+	}
+
+	return r, nil
+}
+
+func (r *HARRecorder) requestWillBeSent(ev *network.RequestWillBeSentReply) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	started := time.Now()
+	if ev.WallTime != 0 {
+		started = ev.WallTime.Time()
+	}
+
+	// A redirect reuses the request ID, finish the previous hop with the
+	// redirect response.
+	if rec, ok := r.pending[ev.RequestID]; ok && ev.RedirectResponse != nil {
+		rec.setResponse(ev.RedirectResponse)
+		rec.entry.Response.RedirectURL = ev.Request.URL
+		rec.responseAt, rec.end = ev.Timestamp, ev.Timestamp
+		delete(r.pending, ev.RequestID)
+	}
+
+	if r.pageStart == 0 {
+		r.pageStart = ev.Timestamp
+		r.page.StartedDateTime = started.Format(time.RFC3339Nano)
+		r.page.Title = ev.Request.URL
+	}
+
+	rec := &harRecord{
+		start: ev.Timestamp,
+		entry: HAREntry{
+			PageRef:         harPageID,
+			StartedDateTime: started.Format(time.RFC3339Nano),
+			Request: HARRequest{
+				Method:      ev.Request.Method,
+				URL:         ev.Request.URL,
+				HTTPVersion: "HTTP/1.1",
+				Cookies:     []HARNameValue{},
+				Headers:     harHeaders(ev.Request.Headers),
+				QueryString: harQueryString(ev.Request.URL),
+				HeadersSize: -1,
+			},
+			Response: HARResponse{
+				Cookies:     []HARNameValue{},
+				Headers:     []HARNameValue{},
+				HeadersSize: -1,
+			},
+		},
+	}
+	if ev.Request.PostData != nil {
+		rec.entry.Request.PostData = &HARPostData{
+			MimeType: harHeader(rec.entry.Request.Headers, "Content-Type"),
+			Text:     *ev.Request.PostData,
+		}
+		rec.entry.Request.BodySize = len(*ev.Request.PostData)
+	}
+
+	r.records = append(r.records, rec)
+	r.pending[ev.RequestID] = rec
+}
+
+func (rec *harRecord) setResponse(resp *network.Response) {
+	version := harHTTPVersion(resp.Protocol)
+	rec.entry.Request.HTTPVersion = version
+	if len(resp.RequestHeaders) > 0 {
+		// What was actually sent, including the cookies
+		rec.entry.Request.Headers = harHeaders(resp.RequestHeaders)
+	}
+	if resp.RequestHeadersText != nil {
+		rec.entry.Request.HeadersSize = len(*resp.RequestHeadersText)
+	}
+
+	rec.entry.Response.Status = resp.Status
+	rec.entry.Response.StatusText = resp.StatusText
+	rec.entry.Response.HTTPVersion = version
+	rec.entry.Response.Headers = harHeaders(resp.Headers)
+	rec.entry.Response.Content.MimeType = resp.MimeType
+	if resp.HeadersText != nil {
+		rec.headers = len(*resp.HeadersText)
+		rec.entry.Response.HeadersSize = rec.headers
+	}
+	if location := harHeader(rec.entry.Response.Headers, "Location"); location != "" {
+		rec.entry.Response.RedirectURL = location
+	}
+	if resp.RemoteIPAddress != nil {
+		rec.entry.ServerIPAddress = *resp.RemoteIPAddress
+	}
+	rec.timing = resp.Timing
+}
+
+// finish computes the timings of the entry. Requests still in flight end at
+// the last event seen.
+func (rec *harRecord) finish() HAREntry {
+	entry := rec.entry
+	end := rec.end
+	if end == 0 {
+		end = rec.responseAt
+	}
+	if end == 0 {
+		end = rec.start
+	}
+
+	t := HARTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1}
+	if timing := rec.timing; timing != nil && timing.RequestTime > 0 {
+		// The timing phases are in milliseconds since RequestTime
+		if start := firstNonNegative(timing.DNSStart, timing.ConnectStart, timing.SendStart); start >= 0 {
+			t.Blocked = start
+		}
+		if timing.DNSStart >= 0 {
+			t.DNS = timing.DNSEnd - timing.DNSStart
+		}
+		if timing.ConnectStart >= 0 {
+			t.Connect = timing.ConnectEnd - timing.ConnectStart
+		}
+		if timing.SslStart >= 0 {
+			t.SSL = timing.SslEnd - timing.SslStart
+		}
+		t.Send = timing.SendEnd - timing.SendStart
+		t.Wait = timing.ReceiveHeadersEnd - timing.SendEnd
+		t.Receive = milliseconds(end-network.MonotonicTime(timing.RequestTime)) - timing.ReceiveHeadersEnd
+	} else if rec.responseAt != 0 {
+		t.Wait = milliseconds(rec.responseAt - rec.start)
+		t.Receive = milliseconds(end - rec.responseAt)
+	}
+	if t.Receive < 0 {
+		t.Receive = 0
+	}
+
+	entry.Timings = t
+	entry.Time = t.Send + t.Wait + t.Receive
+	for _, phase := range []float64{t.Blocked, t.DNS, t.Connect} {
+		if phase > 0 {
+			entry.Time += phase
+		}
+	}
+	return entry
+}
+
+// HAR returns the document of what was recorded so far.
+func (r *HARRecorder) HAR() *HAR {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := make([]HAREntry, 0, len(r.records))
+	for _, rec := range r.records {
+		entries = append(entries, rec.finish())
+	}
+
+	var pages []HARPage
+	if r.pageStart != 0 {
+		pages = append(pages, r.page)
+	} else {
+		pages = []HARPage{}
+	}
+
+	return &HAR{
+		Log: HARLog{
+			Version: "1.2",
+			Creator: HARCreator{
+				Name:    "cdp-screenshots",
+				Version: "1.0",
+			},
+			Pages:   pages,
+			Entries: entries,
+		},
+	}
+}
+
+// MarshalHAR returns the JSON encoded document of what was recorded so far.
+func (r *HARRecorder) MarshalHAR() ([]byte, error) {
+	data, err := json.MarshalIndent(r.HAR(), "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to encode the har")
+	}
+	return data, nil
+}
+
+// Close stops the recording.
+func (r *HARRecorder) Close() {
+	r.close()
+}
+
+// harHeaders converts the headers object of the protocol, in which repeated
+// headers are joined by new lines.
+func harHeaders(headers network.Headers) []HARNameValue {
+	values := map[string]interface{}{}
+	if len(headers) > 0 {
+		json.Unmarshal(headers, &values)
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := []HARNameValue{}
+	for _, name := range names {
+		value, _ := values[name].(string)
+		for _, v := range strings.Split(value, "\n") {
+			result = append(result, HARNameValue{Name: name, Value: v})
+		}
+	}
+	return result
+}
+
+func harHeader(headers []HARNameValue, name string) string {
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+func harQueryString(rawurl string) []HARNameValue {
+	result := []HARNameValue{}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return result
+	}
+
+	query := u.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, v := range query[name] {
+			result = append(result, HARNameValue{Name: name, Value: v})
+		}
+	}
+	return result
+}
+
+func harHTTPVersion(protocol *string) string {
+	if protocol == nil || *protocol == "" {
+		return "HTTP/1.1"
+	}
+	switch p := strings.ToLower(*protocol); {
+	case p == "h2":
+		return "HTTP/2.0"
+	case strings.HasPrefix(p, "http/"):
+		return strings.ToUpper(p)
+	default:
+		return p
+	}
+}
+
+// firstNonNegative returns the first non-negative value, -1 if there isn't any.
+func firstNonNegative(values ...float64) float64 {
+	for _, v := range values {
+		if v >= 0 {
+			return v
+		}
+	}
+	return -1
+}
+
+func milliseconds(seconds network.MonotonicTime) float64 {
+	return float64(seconds) * 1000
+}
@@ -0,0 +1,30 @@
+package screenshot
+
+import (
+	"encoding/base64"
+	"html"
+	"regexp"
+)
+
+var headTag = regexp.MustCompile(`(?i)<head(\s[^>]*)?>`)
+
+// DataURL encodes the HTML into a data URL, so that it can be navigated to
+// without serving it. Relative links are resolved against baseURL if set.
+func DataURL(document, baseURL string) string {
+	return "data:text/html;charset=utf-8;base64," + base64.StdEncoding.EncodeToString(
+		[]byte(WithBaseURL(document, baseURL)),
+	)
+}
+
+// WithBaseURL adds a <base> element pointing at baseURL to the document.
+func WithBaseURL(document, baseURL string) string {
+	if baseURL == "" {
+		return document
+	}
+
+	base := `<base href="` + html.EscapeString(baseURL) + `">`
+	if loc := headTag.FindStringIndex(document); loc != nil {
+		return document[:loc[1]] + base + document[loc[1]:]
+	}
+	return base + document
+}
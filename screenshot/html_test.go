@@ -0,0 +1,48 @@
+package screenshot
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestWithBaseURL(t *testing.T) {
+	const base = `<base href="http://127.0.0.1:8001/bundle/">`
+
+	tests := []struct {
+		name     string
+		document string
+		baseURL  string
+		want     string
+	}{
+		{"no base url", "<html><head></head></html>", "", "<html><head></head></html>"},
+		{"head", "<html><head><title>t</title></head></html>", "http://127.0.0.1:8001/bundle/", "<html><head>" + base + "<title>t</title></head></html>"},
+		{"head with attributes", `<HTML><HEAD lang="en"></HEAD></HTML>`, "http://127.0.0.1:8001/bundle/", `<HTML><HEAD lang="en">` + base + "</HEAD></HTML>"},
+		{"only the first head", "<head></head><head></head>", "http://127.0.0.1:8001/bundle/", "<head>" + base + "</head><head></head>"},
+		{"header isn't a head", "<body><header>h</header></body>", "http://127.0.0.1:8001/bundle/", base + "<body><header>h</header></body>"},
+		{"no head", "<p>hello</p>", "http://127.0.0.1:8001/bundle/", base + "<p>hello</p>"},
+		{"empty document", "", "http://127.0.0.1:8001/bundle/", base},
+		{"escaped url", "<p>x</p>", `http://example.com/?a=1&b="><script>`, `<base href="http://example.com/?a=1&amp;b=&#34;&gt;&lt;script&gt;"><p>x</p>`},
+	}
+	for _, test := range tests {
+		if got := WithBaseURL(test.document, test.baseURL); got != test.want {
+			t.Errorf("%s: WithBaseURL() = %q, expected %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDataURL(t *testing.T) {
+	const prefix = "data:text/html;charset=utf-8;base64,"
+
+	url := DataURL("<head></head><p>ü</p>", "http://127.0.0.1:8001/bundle/")
+	if !strings.HasPrefix(url, prefix) {
+		t.Fatalf("DataURL() = %q, expected the %q prefix", url, prefix)
+	}
+	document, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(url, prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<head><base href="http://127.0.0.1:8001/bundle/"></head><p>ü</p>`; string(document) != want {
+		t.Errorf("DataURL() decodes to %q, expected %q", document, want)
+	}
+}
@@ -0,0 +1,119 @@
+package screenshot
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mafredri/cdp"
+	"github.com/mafredri/cdp/protocol/network"
+	"github.com/pkg/errors"
+)
+
+// RequestFilter decides whether an intercepted request may continue. Returning
+// anything other than network.ErrorReasonNotSet fails the request with that
+// reason. Requests failed with network.ErrorReasonAccessDenied are counted
+// as denied, the others as blocked.
+type RequestFilter func(ctx context.Context, req *network.RequestInterceptedReply) network.ErrorReason
+
+type interceptor struct {
+	blocked int64 // accessed atomically, keep it 64-bit aligned
+	denied  int64 // accessed atomically, keep it 64-bit aligned
+
+	client  *cdp.Client
+	stream  network.RequestInterceptedClient
+	filters []RequestFilter
+	pending sync.WaitGroup
+	done    chan struct{}
+}
+
+// interceptRequests enables request interception on the page and runs every
+// request through the filters until Close is called. It returns nil if there
+// is nothing to filter.
+func interceptRequests(ctx context.Context, client *cdp.Client, filters ...RequestFilter) (*interceptor, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	stream, err := client.Network.RequestIntercepted(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to setup a listener to RequestIntercepted")
+	}
+
+	if err := client.Network.Enable(ctx, network.NewEnableArgs()); err != nil {
+		stream.Close()
+		return nil, errors.Wrap(err, "unable to enable the network domain")
+	}
+
+	if err := client.Network.SetRequestInterceptionEnabled(
+		ctx, network.NewSetRequestInterceptionEnabledArgs(true),
+	); err != nil {
+		stream.Close()
+		return nil, errors.Wrap(err, "unable to enable request interception")
+	}
+
+	i := &interceptor{
+		client:  client,
+		stream:  stream,
+		filters: filters,
+		done:    make(chan struct{}),
+	}
+	go i.run(ctx)
+
+	return i, nil
+}
+
+func (i *interceptor) run(ctx context.Context) {
+	defer close(i.done)
+	defer i.pending.Wait()
+
+	for {
+		req, err := i.stream.Recv()
+		if err != nil {
+			return
+		}
+
+		// Filters may block on DNS lookups, don't hold up other requests.
+		i.pending.Add(1)
+		go i.handle(ctx, req)
+	}
+}
+
+func (i *interceptor) handle(ctx context.Context, req *network.RequestInterceptedReply) {
+	defer i.pending.Done()
+
+	args := network.NewContinueInterceptedRequestArgs(req.InterceptionID)
+	for _, filter := range i.filters {
+		if reason := filter(ctx, req); reason != network.ErrorReasonNotSet {
+			if reason == network.ErrorReasonAccessDenied {
+				atomic.AddInt64(&i.denied, 1)
+			} else {
+				atomic.AddInt64(&i.blocked, 1)
+			}
+			args = args.SetErrorReason(reason)
+			break
+		}
+	}
+
+	if err := i.client.Network.ContinueInterceptedRequest(ctx, args); err != nil {
+		log.Printf("Unable to continue the intercepted request to %s: %v", req.Request.URL, err)
+	}
+}
+
+// Blocked returns how many requests were blocked by the filters so far.
+func (i *interceptor) Blocked() int64 {
+	return atomic.LoadInt64(&i.blocked)
+}
+
+// Denied returns how many requests were denied by the filters so far.
+func (i *interceptor) Denied() int64 {
+	return atomic.LoadInt64(&i.denied)
+}
+
+// Close stops intercepting and waits for the pending requests to be handled.
+func (i *interceptor) Close() error {
+	err := i.stream.Close()
+	<-i.done
+	return err
+}
@@ -0,0 +1,215 @@
+package screenshot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mafredri/cdp"
+	"github.com/mafredri/cdp/protocol/network"
+	"github.com/pkg/errors"
+)
+
+// LazyLoad configures scrolling through the page before a full page capture,
+// so that the content loaded on scroll is there.
+type LazyLoad struct {
+	StepSize    int           // in CSS pixels, the viewport height by default
+	Pause       time.Duration // after each step, 100ms by default
+	MaxDuration time.Duration // of scrolling and settling together, 10s by default
+}
+
+// networkQuietPeriod is how long no request has to be in flight for the
+// network to count as settled.
+const networkQuietPeriod = 500 * time.Millisecond
+
+// triggerLazyLoad scrolls the page down step by step until it reaches the
+// bottom, which may move as content loads, then back to the top and waits
+// for the images and the network to settle.
+func triggerLazyLoad(ctx context.Context, client *cdp.Client, lazy *LazyLoad) error {
+	pause := lazy.Pause
+	if pause <= 0 {
+		pause = 100 * time.Millisecond
+	}
+	maxDuration := lazy.MaxDuration
+	if maxDuration <= 0 {
+		maxDuration = 10 * time.Second
+	}
+	deadline := time.Now().Add(maxDuration)
+
+	idle, err := watchNetwork(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer idle.Close()
+
+	var (
+		position int
+		steps    int
+	)
+	for time.Now().Before(deadline) {
+		var page struct {
+			ScrollHeight int `json:"scrollHeight"`
+			InnerHeight  int `json:"innerHeight"`
+		}
+		if err := evaluate(ctx, client, `({
+			scrollHeight: Math.max(document.body ? document.body.scrollHeight : 0, document.documentElement.scrollHeight),
+			innerHeight: window.innerHeight
+		})`, &page); err != nil {
+			return errors.Wrap(err, "unable to measure the page")
+		}
+
+		if position+page.InnerHeight >= page.ScrollHeight {
+			break
+		}
+
+		step := lazy.StepSize
+		if step <= 0 {
+			step = page.InnerHeight
+		}
+		if step <= 0 {
+			step = 500
+		}
+		position += step
+
+		if err := evaluate(ctx, client, fmt.Sprintf("window.scrollTo(0, %d)", position), nil); err != nil {
+			return errors.Wrap(err, "unable to scroll the page")
+		}
+		steps++
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "unable to finish scrolling")
+		case <-time.After(pause):
+		}
+	}
+
+	if err := evaluate(ctx, client, "window.scrollTo(0, 0)", nil); err != nil {
+		return errors.Wrap(err, "unable to scroll back to the top")
+	}
+
+	log.Printf("Scrolled through the page in %d steps", steps)
+
+	// Wait for the images to decode and the requests they started to finish,
+	// whatever is left of the time.
+	settleCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	if err := evaluate(settleCtx, client, `Promise.all(Array.prototype.map.call(document.images, function(img) {
+		if (img.complete) {
+			return null;
+		}
+		return new Promise(function(resolve) {
+			img.addEventListener('load', resolve);
+			img.addEventListener('error', resolve);
+		});
+	}))`, nil); err != nil {
+		log.Printf("Not all the images loaded: %v", err)
+	}
+	if err := idle.Wait(settleCtx, networkQuietPeriod); err != nil {
+		log.Printf("The network didn't settle: %v", err)
+	}
+
+	return waitForLayout(ctx, client)
+}
+
+// networkIdle tracks the number of requests in flight.
+type networkIdle struct {
+	mu       sync.Mutex
+	inflight map[network.RequestID]struct{}
+	changed  time.Time
+
+	listeners
+}
+
+// watchNetwork starts tracking the requests of the page.
+func watchNetwork(ctx context.Context, client *cdp.Client) (*networkIdle, error) {
+	n := &networkIdle{
+		inflight: map[network.RequestID]struct{}{},
+		changed:  time.Now(),
+	}
+
+	started, err := client.Network.RequestWillBeSent(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to setup a listener to RequestWillBeSent")
+	}
+	n.listen(started, func() error {
+		ev, err := started.Recv()
+		if err != nil {
+			return err
+		}
+		n.mu.Lock()
+		n.inflight[ev.RequestID] = struct{}{}
+		n.changed = time.Now()
+		n.mu.Unlock()
+		return nil
+	})
+
+	finished, err := client.Network.LoadingFinished(ctx)
+	if err != nil {
+		n.Close()
+		return nil, errors.Wrap(err, "unable to setup a listener to LoadingFinished")
+	}
+	n.listen(finished, func() error {
+		ev, err := finished.Recv()
+		if err != nil {
+			return err
+		}
+		n.done(ev.RequestID)
+		return nil
+	})
+
+	failed, err := client.Network.LoadingFailed(ctx)
+	if err != nil {
+		n.Close()
+		return nil, errors.Wrap(err, "unable to setup a listener to LoadingFailed")
+	}
+	n.listen(failed, func() error {
+		ev, err := failed.Recv()
+		if err != nil {
+			return err
+		}
+		n.done(ev.RequestID)
+		return nil
+	})
+
+	if err := client.Network.Enable(ctx, network.NewEnableArgs()); err != nil {
+		n.Close()
+		return nil, errors.Wrap(err, "unable to enable the Network domain")
+	}
+
+	return n, nil
+}
+
+func (n *networkIdle) done(id network.RequestID) {
+	n.mu.Lock()
+	if _, ok := n.inflight[id]; ok {
+		delete(n.inflight, id)
+		n.changed = time.Now()
+	}
+	n.mu.Unlock()
+}
+
+// Wait returns once no request has been in flight for the quiet period.
+func (n *networkIdle) Wait(ctx context.Context, quiet time.Duration) error {
+	for {
+		n.mu.Lock()
+		idle := len(n.inflight) == 0 && time.Since(n.changed) >= quiet
+		n.mu.Unlock()
+		if idle {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// Close stops tracking the requests.
+func (n *networkIdle) Close() {
+	n.close()
+}
@@ -0,0 +1,183 @@
+package screenshot
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/mafredri/cdp"
+	"github.com/mafredri/cdp/protocol/emulation"
+	"github.com/mafredri/cdp/rpcc"
+	"github.com/pkg/errors"
+)
+
+// Geolocation is an emulated position of the device.
+type Geolocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Accuracy  float64 `json:"accuracy"` // in meters
+}
+
+// localePattern loosely matches BCP 47 language tags, eg. en, de-AT or
+// zh-Hant-TW.
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// ValidateLocale checks the format of the locale, the timezone is checked
+// by Chrome itself.
+func ValidateLocale(locale string) error {
+	if locale != "" && !localePattern.MatchString(locale) {
+		return errors.Errorf("invalid locale %q", locale)
+	}
+	return nil
+}
+
+// Validate checks the coordinates.
+func (g *Geolocation) Validate() error {
+	if g.Latitude < -90 || g.Latitude > 90 {
+		return errors.Errorf("invalid latitude %v", g.Latitude)
+	}
+	if g.Longitude < -180 || g.Longitude > 180 {
+		return errors.Errorf("invalid longitude %v", g.Longitude)
+	}
+	if g.Accuracy < 0 {
+		return errors.Errorf("invalid accuracy %v", g.Accuracy)
+	}
+	return nil
+}
+
+// emulateTimezone overrides the timezone of the page and checks that it
+// took effect, so that the dates don't silently follow the host.
+func emulateTimezone(ctx context.Context, client *cdp.Client, conn *rpcc.Conn, timezone string) error {
+	if timezone == "" {
+		return nil
+	}
+	if conn == nil {
+		return errors.New("emulating the timezone requires the connection")
+	}
+
+	args := struct {
+		TimezoneID string `json:"timezoneId"`
+	}{timezone}
+	if err := rpcc.Invoke(ctx, "Emulation.setTimezoneOverride", &args, nil, conn); err != nil {
+		return errors.Wrapf(err, "unable to emulate the timezone %s", timezone)
+	}
+
+	var resolved string
+	if err := evaluate(ctx, client, `Intl.DateTimeFormat().resolvedOptions().timeZone`, &resolved); err != nil {
+		return errors.Wrap(err, "unable to check the timezone")
+	}
+	if resolved != timezone {
+		return errors.Errorf("the timezone %s is not supported by this Chrome, got %s", timezone, resolved)
+	}
+
+	log.Printf("Emulated the %s timezone", timezone)
+
+	return nil
+}
+
+// emulateLocale overrides the locale used by Intl and the Accept-Language
+// header and navigator.languages of the page.
+func emulateLocale(ctx context.Context, client *cdp.Client, conn *rpcc.Conn, locale string) error {
+	if locale == "" {
+		return nil
+	}
+	if err := ValidateLocale(locale); err != nil {
+		return err
+	}
+	if conn == nil {
+		return errors.New("emulating the locale requires the connection")
+	}
+
+	localeArgs := struct {
+		Locale string `json:"locale"`
+	}{locale}
+	if err := rpcc.Invoke(ctx, "Emulation.setLocaleOverride", &localeArgs, nil, conn); err != nil {
+		return errors.Wrapf(err, "unable to emulate the locale %s", locale)
+	}
+
+	// The user agent is required, keep the current one
+	version, err := client.Browser.GetVersion(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to get the user agent")
+	}
+	uaArgs := struct {
+		UserAgent      string `json:"userAgent"`
+		AcceptLanguage string `json:"acceptLanguage"`
+	}{version.UserAgent, locale}
+	if err := rpcc.Invoke(ctx, "Network.setUserAgentOverride", &uaArgs, nil, conn); err != nil {
+		return errors.Wrap(err, "unable to override the accepted languages")
+	}
+
+	var resolved string
+	if err := evaluate(ctx, client, `Intl.DateTimeFormat().resolvedOptions().locale`, &resolved); err != nil {
+		return errors.Wrap(err, "unable to check the locale")
+	}
+	if !strings.EqualFold(resolved, locale) {
+		return errors.Errorf("the locale %s is not supported by this Chrome, got %s", locale, resolved)
+	}
+
+	log.Printf("Emulated the %s locale", locale)
+
+	return nil
+}
+
+// emulateGeolocation overrides the position of the device and grants the
+// origin of the page the permission to read it, within the browser context
+// of the target. The grant is skipped for the pages without an origin, eg.
+// data: urls. Call ResetPermissions once the target is done.
+func emulateGeolocation(ctx context.Context, client *cdp.Client, conn *rpcc.Conn, geo *Geolocation, pageURL, browserContext string) error {
+	if geo == nil {
+		return nil
+	}
+	if err := geo.Validate(); err != nil {
+		return err
+	}
+	if conn == nil {
+		return errors.New("emulating the geolocation requires the connection")
+	}
+
+	args := emulation.NewSetGeolocationOverrideArgs().
+		SetLatitude(geo.Latitude).
+		SetLongitude(geo.Longitude).
+		SetAccuracy(geo.Accuracy)
+	if err := client.Emulation.SetGeolocationOverride(ctx, args); err != nil {
+		return errors.Wrap(err, "unable to emulate the geolocation")
+	}
+
+	u, err := url.Parse(pageURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		log.Print("Not granting the geolocation permission to a page without an origin")
+	} else {
+		grant := struct {
+			Origin           string   `json:"origin"`
+			Permissions      []string `json:"permissions"`
+			BrowserContextID string   `json:"browserContextId,omitempty"`
+		}{
+			Origin:           u.Scheme + "://" + u.Host,
+			Permissions:      []string{"geolocation"},
+			BrowserContextID: browserContext,
+		}
+		if err := rpcc.Invoke(ctx, "Browser.grantPermissions", &grant, nil, conn); err != nil {
+			return errors.Wrap(err, "unable to grant the geolocation permission")
+		}
+	}
+
+	log.Printf("Emulated the geolocation %v,%v", geo.Latitude, geo.Longitude)
+
+	return nil
+}
+
+// ResetPermissions revokes the permissions granted by emulateGeolocation in
+// the browser context. An empty context stands for the default one, shared
+// by every target without a context of its own.
+func ResetPermissions(ctx context.Context, conn *rpcc.Conn, browserContext string) error {
+	args := struct {
+		BrowserContextID string `json:"browserContextId,omitempty"`
+	}{browserContext}
+	if err := rpcc.Invoke(ctx, "Browser.resetPermissions", &args, nil, conn); err != nil {
+		return errors.Wrap(err, "unable to reset the permissions")
+	}
+	return nil
+}
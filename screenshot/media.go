@@ -0,0 +1,123 @@
+package screenshot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/mafredri/cdp"
+	"github.com/mafredri/cdp/protocol/emulation"
+	"github.com/mafredri/cdp/rpcc"
+	"github.com/pkg/errors"
+)
+
+// MediaTypes are the values of Options.Media.
+var MediaTypes = []string{"screen", "print"}
+
+// MediaFeatures are the supported keys of Options.MediaFeatures along with
+// their allowed values.
+var MediaFeatures = map[string][]string{
+	"prefers-color-scheme":   {"light", "dark", "no-preference"},
+	"prefers-reduced-motion": {"reduce", "no-preference"},
+	"prefers-contrast":       {"more", "less", "no-preference"},
+	"forced-colors":          {"active", "none"},
+}
+
+// mediaFeature is the MediaFeature type of newer protocols.
+type mediaFeature struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// setEmulatedMediaArgs adds the features argument of newer protocols to
+// emulation.SetEmulatedMediaArgs.
+type setEmulatedMediaArgs struct {
+	Media    string         `json:"media"`
+	Features []mediaFeature `json:"features,omitempty"`
+}
+
+// ValidateMedia checks the media type and features against the known ones.
+func ValidateMedia(media string, features map[string]string) error {
+	if media != "" && !contains(MediaTypes, media) {
+		return errors.Errorf("invalid emulated media %q", media)
+	}
+	for name, value := range features {
+		values, ok := MediaFeatures[name]
+		if !ok {
+			return errors.Errorf("unknown media feature %q", name)
+		}
+		if !contains(values, value) {
+			return errors.Errorf("invalid value %q of the media feature %s", value, name)
+		}
+	}
+	return nil
+}
+
+// emulateMedia applies the media type and features to the page. The features
+// are only known to newer protocols, so they are sent over the raw conn and
+// then checked with matchMedia, as older Chromes ignore unknown arguments.
+func emulateMedia(ctx context.Context, client *cdp.Client, conn *rpcc.Conn, media string, features map[string]string) error {
+	if err := ValidateMedia(media, features); err != nil {
+		return err
+	}
+
+	if len(features) == 0 {
+		if media == "" {
+			return nil
+		}
+		if err := client.Emulation.SetEmulatedMedia(ctx, emulation.NewSetEmulatedMediaArgs(media)); err != nil {
+			return errors.Wrap(err, "unable to emulate the media")
+		}
+		log.Printf("Emulated the %s media", media)
+		return nil
+	}
+
+	if conn == nil {
+		return errors.New("emulating media features requires the connection")
+	}
+
+	names := make([]string, 0, len(features))
+	for name := range features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := &setEmulatedMediaArgs{Media: media}
+	for _, name := range names {
+		args.Features = append(args.Features, mediaFeature{Name: name, Value: features[name]})
+	}
+	if err := rpcc.Invoke(ctx, "Emulation.setEmulatedMedia", args, nil, conn); err != nil {
+		return errors.Wrap(err, "unable to emulate the media features")
+	}
+
+	var unsupported []string
+	for _, f := range args.Features {
+		query, _ := json.Marshal(fmt.Sprintf("(%s: %s)", f.Name, f.Value))
+
+		var matches bool
+		if err := evaluate(ctx, client, fmt.Sprintf("matchMedia(%s).matches", query), &matches); err != nil {
+			return errors.Wrap(err, "unable to check the media features")
+		}
+		if !matches {
+			unsupported = append(unsupported, f.Name+": "+f.Value)
+		}
+	}
+	if len(unsupported) > 0 {
+		return errors.Errorf("the media features %v are not supported by this Chrome", unsupported)
+	}
+
+	log.Printf("Emulated the media features %v", args.Features)
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
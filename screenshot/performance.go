@@ -0,0 +1,155 @@
+package screenshot
+
+import (
+	"context"
+	"log"
+
+	"github.com/mafredri/cdp"
+	"github.com/pkg/errors"
+)
+
+// Performance holds the performance numbers of the captured page. The times
+// are in milliseconds since the start of the navigation, 0 when unknown.
+type Performance struct {
+	Metrics    map[string]float64 `json:"metrics"` // as reported by Performance.getMetrics
+	Navigation *NavigationTiming  `json:"navigation,omitempty"`
+
+	FirstPaint             float64 `json:"first_paint"`
+	FirstContentfulPaint   float64 `json:"first_contentful_paint"`
+	LargestContentfulPaint float64 `json:"largest_contentful_paint"`
+	LayoutShifts           int     `json:"layout_shifts"` // not counting the ones caused by input
+	CumulativeLayoutShift  float64 `json:"cumulative_layout_shift"`
+}
+
+// NavigationTiming is the navigation timing of the document.
+type NavigationTiming struct {
+	FetchStart       float64 `json:"fetch_start"`
+	DNSStart         float64 `json:"dns_start"`
+	DNSEnd           float64 `json:"dns_end"`
+	ConnectStart     float64 `json:"connect_start"`
+	ConnectEnd       float64 `json:"connect_end"`
+	RequestStart     float64 `json:"request_start"`
+	ResponseStart    float64 `json:"response_start"`
+	ResponseEnd      float64 `json:"response_end"`
+	DOMInteractive   float64 `json:"dom_interactive"`
+	DOMContentLoaded float64 `json:"dom_content_loaded"`
+	DOMComplete      float64 `json:"dom_complete"`
+	Load             float64 `json:"load"`
+}
+
+// performanceScript reads the navigation timing, paint timing and layout
+// shifts of the page. Layout shifts and the largest contentful paint are
+// only exposed to buffered observers, which older Chromes don't support.
+const performanceScript = `new Promise(function(resolve) {
+	var result = {
+		navigation: null,
+		first_paint: 0,
+		first_contentful_paint: 0,
+		largest_contentful_paint: 0,
+		layout_shifts: 0,
+		cumulative_layout_shift: 0
+	};
+
+	var nav = performance.getEntriesByType ? performance.getEntriesByType('navigation')[0] : null;
+	if (nav) {
+		result.navigation = {
+			fetch_start: nav.fetchStart,
+			dns_start: nav.domainLookupStart,
+			dns_end: nav.domainLookupEnd,
+			connect_start: nav.connectStart,
+			connect_end: nav.connectEnd,
+			request_start: nav.requestStart,
+			response_start: nav.responseStart,
+			response_end: nav.responseEnd,
+			dom_interactive: nav.domInteractive,
+			dom_content_loaded: nav.domContentLoadedEventEnd,
+			dom_complete: nav.domComplete,
+			load: nav.loadEventEnd
+		};
+	} else if (performance.timing) {
+		var t = performance.timing, since = function(v) { return v ? v - t.navigationStart : 0; };
+		result.navigation = {
+			fetch_start: since(t.fetchStart),
+			dns_start: since(t.domainLookupStart),
+			dns_end: since(t.domainLookupEnd),
+			connect_start: since(t.connectStart),
+			connect_end: since(t.connectEnd),
+			request_start: since(t.requestStart),
+			response_start: since(t.responseStart),
+			response_end: since(t.responseEnd),
+			dom_interactive: since(t.domInteractive),
+			dom_content_loaded: since(t.domContentLoadedEventEnd),
+			dom_complete: since(t.domComplete),
+			load: since(t.loadEventEnd)
+		};
+	}
+
+	(performance.getEntriesByType ? performance.getEntriesByType('paint') : []).forEach(function(entry) {
+		if (entry.name === 'first-paint') {
+			result.first_paint = entry.startTime;
+		} else if (entry.name === 'first-contentful-paint') {
+			result.first_contentful_paint = entry.startTime;
+		}
+	});
+
+	var record = function(entry) {
+		if (entry.entryType === 'layout-shift' && !entry.hadRecentInput) {
+			result.layout_shifts++;
+			result.cumulative_layout_shift += entry.value;
+		} else if (entry.entryType === 'largest-contentful-paint') {
+			result.largest_contentful_paint = Math.max(result.largest_contentful_paint, entry.startTime);
+		}
+	};
+
+	var observers = [];
+	['layout-shift', 'largest-contentful-paint'].forEach(function(type) {
+		try {
+			var observer = new PerformanceObserver(function(list) { list.getEntries().forEach(record); });
+			observer.observe({type: type, buffered: true});
+			observers.push(observer);
+		} catch (e) {
+			// Not supported by this Chrome
+		}
+	});
+
+	// The buffered entries are delivered in a task of their own
+	setTimeout(function() {
+		observers.forEach(function(observer) {
+			observer.takeRecords().forEach(record);
+			observer.disconnect();
+		});
+		resolve(result);
+	}, 0);
+})`
+
+// enablePerformance starts collecting the metrics of Performance.getMetrics,
+// which should be done before navigating.
+func enablePerformance(ctx context.Context, client *cdp.Client) error {
+	if err := client.Performance.Enable(ctx); err != nil {
+		return errors.Wrap(err, "unable to enable the Performance domain")
+	}
+	return nil
+}
+
+// CollectPerformance reads the performance metrics of the page. The
+// Performance domain has to be enabled before the page is loaded for the
+// metrics to be complete.
+func CollectPerformance(ctx context.Context, client *cdp.Client) (*Performance, error) {
+	perf := &Performance{}
+	if err := evaluate(ctx, client, performanceScript, perf); err != nil {
+		return nil, errors.Wrap(err, "unable to read the performance timing")
+	}
+
+	reply, err := client.Performance.GetMetrics(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get the performance metrics")
+	}
+	perf.Metrics = make(map[string]float64, len(reply.Metrics))
+	for _, metric := range reply.Metrics {
+		perf.Metrics[metric.Name] = metric.Value
+	}
+
+	log.Printf("Collected %d performance metrics", len(perf.Metrics))
+
+	return perf, nil
+}
@@ -0,0 +1,178 @@
+package screenshot
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/mafredri/cdp/protocol/network"
+	"github.com/pkg/errors"
+)
+
+// deniedNetworks are the ranges a page must not reach unless allowed
+// explicitly: loopback, private, link-local, carrier-grade NAT, unspecified
+// and multicast addresses.
+var deniedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// NetworkPolicy keeps pages from reaching internal hosts. Host names are
+// resolved and every address they point to must be public, unless the host
+// is on the allow-list. Lookups are cached for the lifetime of the policy,
+// so create a new one for every capture.
+//
+// The policy checks the requests Chrome lets intercept, it doesn't sit in
+// the network path. Chrome resolves the hosts again on its own, so a host
+// whose records change between the lookups (DNS rebinding) may still reach
+// an internal address, and WebSocket connections aren't intercepted at all.
+// Where that matters, deny the internal ranges in the egress firewall of
+// the renderer as well.
+type NetworkPolicy struct {
+	// AllowedHosts are host names, host:port pairs, IPs or CIDRs which are
+	// trusted even though they resolve to internal addresses.
+	AllowedHosts []string
+	// AllowedPrefixes are URL prefixes which are always let through, such
+	// as the renderer's own HTML server.
+	AllowedPrefixes []string
+	Resolver        *net.Resolver
+
+	cache   map[string]error
+	cacheMu sync.Mutex
+}
+
+// Check returns an error if the URL points at a denied address.
+func (p *NetworkPolicy) Check(ctx context.Context, rawURL string) error {
+	for _, prefix := range p.AllowedPrefixes {
+		if strings.HasPrefix(rawURL, prefix) {
+			return nil
+		}
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return errors.Wrap(err, "unable to parse the url")
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+	case "data", "blob", "about":
+		return nil
+	default:
+		return errors.Errorf("scheme %q is not allowed", u.Scheme)
+	}
+
+	if p.allowed(u) {
+		return nil
+	}
+
+	host := u.Hostname()
+
+	p.cacheMu.Lock()
+	err, ok := p.cache[host]
+	p.cacheMu.Unlock()
+	if ok {
+		return err
+	}
+
+	err = p.checkHost(ctx, host)
+
+	p.cacheMu.Lock()
+	if p.cache == nil {
+		p.cache = map[string]error{}
+	}
+	p.cache[host] = err
+	p.cacheMu.Unlock()
+
+	return err
+}
+
+// Filter is a RequestFilter denying requests and redirects to internal hosts.
+func (p *NetworkPolicy) Filter(ctx context.Context, req *network.RequestInterceptedReply) network.ErrorReason {
+	target := req.Request.URL
+	if req.RedirectURL != nil {
+		target = *req.RedirectURL
+	}
+
+	if err := p.Check(ctx, target); err != nil {
+		log.Printf("Denied a request to %s: %v", target, err)
+		return network.ErrorReasonAccessDenied
+	}
+	return network.ErrorReasonNotSet
+}
+
+func (p *NetworkPolicy) allowed(u *url.URL) bool {
+	for _, entry := range p.AllowedHosts {
+		if strings.EqualFold(entry, u.Hostname()) || strings.EqualFold(entry, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *NetworkPolicy) allowedIP(ip net.IP) bool {
+	for _, entry := range p.AllowedHosts {
+		if _, cidr, err := net.ParseCIDR(entry); err == nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *NetworkPolicy) checkHost(ctx context.Context, host string) error {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		resolver := p.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return errors.Wrapf(err, "unable to resolve %s", host)
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	for _, ip := range ips {
+		if p.allowedIP(ip) {
+			continue
+		}
+		for _, cidr := range deniedNetworks {
+			if cidr.Contains(ip) {
+				return errors.Errorf("%s resolves to the denied address %s", host, ip)
+			}
+		}
+	}
+	return nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets
+}
@@ -0,0 +1,83 @@
+package screenshot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mafredri/cdp/protocol/network"
+)
+
+func TestNetworkPolicyCheck(t *testing.T) {
+	policy := &NetworkPolicy{
+		AllowedHosts:    []string{"10.1.2.0/24", "192.168.1.5", "[::1]:8080"},
+		AllowedPrefixes: []string{"http://127.0.0.1:8001/bundle/"},
+	}
+
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"http://93.184.216.34/", true},
+		{"https://[2606:2800:220:1:248:1893:25c8:1946]/", true},
+		{"http://127.0.0.1/", false},
+		{"http://10.0.0.1/", false},
+		{"http://172.16.5.4:8080/", false},
+		{"http://192.168.1.1/", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://100.64.0.1/", false},
+		{"http://0.0.0.0/", false},
+		{"http://[::1]/", false},
+		{"http://[fd00::1]/", false},
+		{"http://[fe80::1]/", false},
+		{"http://[::ffff:127.0.0.1]/", false},
+
+		// allowed CIDR, host and host:port
+		{"http://10.1.2.3/", true},
+		{"http://10.1.3.3/", false},
+		{"http://192.168.1.5/", true},
+		{"http://[::1]:8080/", true},
+		{"http://[::1]:8081/", false},
+
+		// allowed prefix
+		{"http://127.0.0.1:8001/bundle/index.html", true},
+		{"http://127.0.0.1:8001/other/", false},
+
+		// schemes
+		{"data:text/html,hello", true},
+		{"about:blank", true},
+		{"file:///etc/passwd", false},
+		{"ftp://93.184.216.34/", false},
+		{"ws://93.184.216.34/", false},
+	}
+	for _, test := range tests {
+		err := policy.Check(context.Background(), test.url)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("Check(%q) = %v, expected allowed to be %v", test.url, err, test.allowed)
+		}
+	}
+}
+
+func TestNetworkPolicyFilterRedirect(t *testing.T) {
+	policy := &NetworkPolicy{}
+
+	redirect := "http://169.254.169.254/latest/meta-data/"
+	tests := []struct {
+		name     string
+		url      string
+		redirect *string
+		reason   network.ErrorReason
+	}{
+		{"public", "http://93.184.216.34/", nil, network.ErrorReasonNotSet},
+		{"private", "http://10.0.0.1/", nil, network.ErrorReasonAccessDenied},
+		{"redirect to private", "http://93.184.216.34/", &redirect, network.ErrorReasonAccessDenied},
+	}
+	for _, test := range tests {
+		req := &network.RequestInterceptedReply{
+			Request:     network.Request{URL: test.url},
+			RedirectURL: test.redirect,
+		}
+		if reason := policy.Filter(context.Background(), req); reason != test.reason {
+			t.Errorf("%s: Filter() = %q, expected %q", test.name, reason, test.reason)
+		}
+	}
+}
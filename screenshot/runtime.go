@@ -0,0 +1,45 @@
+package screenshot
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/mafredri/cdp"
+	"github.com/mafredri/cdp/protocol/runtime"
+	"github.com/pkg/errors"
+)
+
+// evaluate runs the expression in the page, awaiting the result if it is
+// a promise, and decodes the returned value onto out unless it's nil.
+func evaluate(ctx context.Context, client *cdp.Client, expression string, out interface{}) error {
+	reply, err := client.Runtime.Evaluate(ctx, runtime.NewEvaluateArgs(expression).
+		SetReturnByValue(true).
+		SetAwaitPromise(true))
+	if err != nil {
+		return errors.Wrap(err, "unable to evaluate the expression")
+	}
+
+	if reply.ExceptionDetails != nil {
+		text := reply.ExceptionDetails.Text
+		if exc := reply.ExceptionDetails.Exception; exc != nil && exc.Description != nil {
+			text = *exc.Description
+		}
+		return errors.Errorf("the expression has thrown: %s", text)
+	}
+
+	if out == nil || len(reply.Result.Value) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(reply.Result.Value, out); err != nil {
+		return errors.Wrap(err, "unable to decode the result of the expression")
+	}
+	return nil
+}
+
+// waitForLayout resolves after the next two animation frames, by which point
+// a change of the viewport has been laid out and painted.
+func waitForLayout(ctx context.Context, client *cdp.Client) error {
+	return evaluate(ctx, client, `new Promise(function(resolve) {
+		requestAnimationFrame(function() { requestAnimationFrame(resolve); });
+	})`, nil)
+}
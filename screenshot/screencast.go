@@ -0,0 +1,211 @@
+package screenshot
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mafredri/cdp"
+	"github.com/mafredri/cdp/protocol/page"
+	"github.com/pkg/errors"
+)
+
+// Animation configures an animated capture recorded using the screencast.
+type Animation struct {
+	Duration  time.Duration
+	FrameRate int  // frames per second, 10 by default
+	MaxFrames int  // recording stops after this many frames, 0 means no limit
+	MaxSize   int  // maximum size of the encoded GIF in bytes, 0 means no limit
+	Frames    bool // also produce a zip of the PNG frames
+}
+
+// animationFrame is a single distinct frame along with the number of ticks
+// it stayed on the screen.
+type animationFrame struct {
+	image image.Image
+	ticks int
+}
+
+// recordAnimation records the page for anim.Duration and encodes the frames
+// into an animated GIF, optionally along with a zip of the PNG frames.
+func recordAnimation(ctx context.Context, client *cdp.Client, anim *Animation, maxWidth, maxHeight int) (*Result, error) {
+	frameRate := anim.FrameRate
+	if frameRate <= 0 {
+		frameRate = 10
+	}
+
+	stream, err := client.Page.ScreencastFrame(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to setup a listener to ScreencastFrame")
+	}
+	defer stream.Close()
+
+	var (
+		latest    image.Image
+		latestSeq int
+		latestMu  sync.Mutex
+		received  = make(chan struct{})
+	)
+	go func() {
+		defer close(received)
+		for {
+			frame, err := stream.Recv()
+			if err != nil {
+				return
+			}
+
+			if err := client.Page.ScreencastFrameAck(ctx, page.NewScreencastFrameAckArgs(frame.SessionID)); err != nil {
+				log.Printf("Unable to acknowledge the screencast frame: %v", err)
+			}
+
+			img, err := png.Decode(bytes.NewReader(frame.Data))
+			if err != nil {
+				log.Printf("Unable to decode the screencast frame: %v", err)
+				continue
+			}
+
+			latestMu.Lock()
+			latest = img
+			latestSeq++
+			latestMu.Unlock()
+		}
+	}()
+
+	args := page.NewStartScreencastArgs().
+		SetFormat("png").
+		SetMaxWidth(maxWidth).
+		SetMaxHeight(maxHeight)
+	if err := client.Page.StartScreencast(ctx, args); err != nil {
+		return nil, errors.Wrap(err, "unable to start the screencast")
+	}
+
+	log.Print("Started the screencast")
+
+	var (
+		frames  []*animationFrame
+		lastSeq int
+		ticker  = time.NewTicker(time.Second / time.Duration(frameRate))
+		end     = time.After(anim.Duration)
+	)
+	defer ticker.Stop()
+
+record:
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "unable to finish the screencast")
+		case <-end:
+			break record
+		case <-ticker.C:
+		}
+
+		latestMu.Lock()
+		img, seq := latest, latestSeq
+		latestMu.Unlock()
+
+		switch {
+		case img == nil:
+			// Nothing painted yet.
+		case seq == lastSeq:
+			frames[len(frames)-1].ticks++
+		default:
+			if anim.MaxFrames > 0 && len(frames) >= anim.MaxFrames {
+				break record
+			}
+			frames = append(frames, &animationFrame{image: img, ticks: 1})
+			lastSeq = seq
+		}
+	}
+
+	if err := client.Page.StopScreencast(ctx); err != nil {
+		return nil, errors.Wrap(err, "unable to stop the screencast")
+	}
+	stream.Close()
+	<-received
+
+	log.Printf("Recorded %d screencast frames", len(frames))
+
+	if len(frames) == 0 {
+		return nil, errors.New("no screencast frames were received")
+	}
+
+	data, err := encodeGIF(frames, 100/frameRate)
+	if err != nil {
+		return nil, err
+	}
+	if anim.MaxSize > 0 && len(data) > anim.MaxSize {
+		return nil, errors.Errorf("the animation is %d bytes, larger than the limit of %d", len(data), anim.MaxSize)
+	}
+
+	result := &Result{
+		Data:     data,
+		Format:   "gif",
+		Frames:   len(frames),
+		Captures: 1,
+	}
+
+	if anim.Frames {
+		archive, err := zipFrames(frames)
+		if err != nil {
+			return nil, err
+		}
+		result.Artifacts = append(result.Artifacts, Artifact{
+			Name:        "frames.zip",
+			ContentType: "application/zip",
+			Data:        archive,
+		})
+	}
+
+	return result, nil
+}
+
+func encodeGIF(frames []*animationFrame, tickDelay int) ([]byte, error) {
+	if tickDelay < 1 {
+		tickDelay = 1
+	}
+
+	anim := &gif.GIF{}
+	for _, frame := range frames {
+		bounds := frame.image.Bounds()
+		paletted := image.NewPaletted(bounds, palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, bounds, frame.image, bounds.Min)
+
+		anim.Image = append(anim.Image, paletted)
+		anim.Delay = append(anim.Delay, frame.ticks*tickDelay)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, anim); err != nil {
+		return nil, errors.Wrap(err, "unable to encode the gif animation")
+	}
+	return buf.Bytes(), nil
+}
+
+func zipFrames(frames []*animationFrame) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+
+	for i, frame := range frames {
+		w, err := archive.Create(fmt.Sprintf("frame-%04d.png", i))
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to add a frame to the archive")
+		}
+		if err := png.Encode(w, frame.image); err != nil {
+			return nil, errors.Wrap(err, "unable to encode a frame")
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, errors.Wrap(err, "unable to finish the frames archive")
+	}
+	return buf.Bytes(), nil
+}
@@ -11,18 +11,117 @@ import (
 
 	"github.com/mafredri/cdp"
 	"github.com/mafredri/cdp/protocol/dom"
-	"github.com/mafredri/cdp/protocol/emulation"
 	"github.com/mafredri/cdp/protocol/page"
+	"github.com/mafredri/cdp/rpcc"
 	"github.com/nfnt/resize"
 	"github.com/pkg/errors"
 )
 
+// HTML loading modes of Options.HTMLMode.
+const (
+	HTMLModeDocument = "document" // navigate to about:blank and replace its document
+	HTMLModeData     = "data"     // navigate to a data URL
+)
+
+// Options describes a single capture performed by Capture.
+type Options struct {
+	URL      string
+	HTML     string // loaded directly instead of navigating to URL when set
+	HTMLMode string // HTMLModeDocument by default
+	BaseURL  string // base of the relative links in HTML
+	Width    int
+	Height   int
+	Scaling  float64
+	Delay    time.Duration
+	FullPage bool
+	LazyLoad *LazyLoad // scrolls through the page before a full page capture
+	Format   string
+	Quality  int
+
+	AdBlocking  bool     // enables Chrome's ad blocker and the Blocklist
+	Blocklist   []string // URL patterns applied when AdBlocking is set
+	BlockedURLs []string // URL patterns that are always blocked
+
+	NetworkPolicy *NetworkPolicy // applied to every request when set
+
+	Media          string            // emulated CSS media type, screen or print
+	MediaFeatures  map[string]string // emulated CSS media features, eg. prefers-color-scheme: dark
+	Timezone       string            // IANA timezone ID, eg. Europe/Prague
+	Locale         string            // BCP 47 language tag, also sent as Accept-Language
+	Geolocation    *Geolocation      // emulated position, readable by the origin of the page
+	Conn           *rpcc.Conn        // connection of the client, needed by the emulations missing from it
+	BrowserContext string            // browser context of the target, which the permissions are granted in
+
+	Steps   []Step        // interactions with the page before it's captured
+	Dialogs *DialogPolicy // how the JavaScript dialogs are resolved, accepted by default
+
+	Deterministic *Deterministic // freezes what changes between the runs
+
+	Animation *Animation // records an animated GIF instead of a screenshot
+	Viewports []Viewport // captures the page once per viewport instead
+
+	Comparison  *Comparison // compares the screenshot with a baseline
+	Fingerprint bool        // computes the perceptual hashes and colours of the screenshot
+
+	SerializedDOM bool // stores the final markup of the page as dom.html
+	MHTML         bool // stores a web archive of the page as page.mhtml
+	HAR           bool // stores the network activity of the page as page.har
+	Performance   bool // collects the performance metrics of the page
+
+	MaxConsoleEntries int  // of each kind in the console log, DefaultMaxConsoleEntries if 0
+	MaxConsoleLength  int  // of a single text in the console log, DefaultMaxConsoleLength if 0
+	FailOnException   bool // fails the capture when the page throws an uncaught exception
+}
+
+// Result is the outcome of a capture. Data is empty when the images are
+// delivered as artifacts, eg. one per viewport.
+type Result struct {
+	Data            []byte            `json:"-"`
+	Format          string            `json:"format"` // png, jpeg or gif
+	Frames          int               `json:"frames,omitempty"`
+	Captures        int               `json:"captures"`         // rendered images, including the viewports and the steps
+	BlockedRequests int64             `json:"blocked_requests"` // by the blocklist
+	DeniedRequests  int64             `json:"denied_requests"`  // by the network policy
+	Comparison      *ComparisonResult `json:"comparison,omitempty"`
+	Fingerprint     *Fingerprint      `json:"fingerprint,omitempty"`
+	Steps           []StepResult      `json:"steps,omitempty"`
+	Dialogs         []Dialog          `json:"dialogs,omitempty"`
+	Console         *ConsoleLog       `json:"console,omitempty"`
+	Performance     *Performance      `json:"performance,omitempty"`
+	Artifacts       []Artifact        `json:"artifacts,omitempty"`
+}
+
+// Artifact is an additional output of a capture, stored next to the image.
+type Artifact struct {
+	Name        string `json:"name"`
+	Label       string `json:"label,omitempty"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"-"`
+}
+
 func TakeScreenshot(
 	ctx context.Context, client *cdp.Client,
 	url string, width, height int, scaling float64,
 	delay time.Duration, fullPage bool, format string,
 	quality int,
 ) ([]byte, error) {
+	result, err := Capture(ctx, client, &Options{
+		URL:      url,
+		Width:    width,
+		Height:   height,
+		Scaling:  scaling,
+		Delay:    delay,
+		FullPage: fullPage,
+		Format:   format,
+		Quality:  quality,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
+
+func Capture(ctx context.Context, client *cdp.Client, opts *Options) (*Result, error) {
 	// Open a DOMContentEventFired client to buffer this event.
 	domContent, err := client.Page.DOMContentEventFired(ctx)
 	if err != nil {
@@ -41,27 +140,128 @@ func TakeScreenshot(
 
 	log.Print("Enabled Page and DOM events")
 
-	// Prepare the viewport.
-	if err := client.Emulation.SetDeviceMetricsOverride(ctx, &emulation.SetDeviceMetricsOverrideArgs{
-		Width:             width,
-		Height:            height,
-		DeviceScaleFactor: 0,
-		Mobile:            false,
-	}); err != nil {
-		return nil, errors.Wrap(err, "unable to set the initial viewport size")
+	// A dialog blocks the page until it's resolved.
+	dialogs, err := HandleDialogs(ctx, client, opts.Dialogs)
+	if err != nil {
+		return nil, err
+	}
+	defer dialogs.Close()
+
+	// Block ads, internal hosts and any explicitly listed URLs before
+	// anything is loaded.
+	var patterns []string
+	if opts.AdBlocking {
+		if err := client.Page.SetAdBlockingEnabled(ctx, page.NewSetAdBlockingEnabledArgs(true)); err != nil {
+			return nil, errors.Wrap(err, "unable to enable ad blocking")
+		}
+		patterns = append(patterns, opts.Blocklist...)
+	}
+	patterns = append(patterns, opts.BlockedURLs...)
+
+	var filters []RequestFilter
+	if opts.NetworkPolicy != nil {
+		filters = append(filters, opts.NetworkPolicy.Filter)
+	}
+	if len(patterns) > 0 {
+		blocklist, err := NewBlocklist(patterns)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to compile the blocked url patterns")
+		}
+		filters = append(filters, blocklist.Filter)
+	}
+
+	interceptor, err := interceptRequests(ctx, client, filters...)
+	if err != nil {
+		return nil, err
+	}
+	if interceptor != nil {
+		defer interceptor.Close()
+	}
+
+	// Record what the page logs, throws and fails to load from now on.
+	console, err := collectConsole(ctx, client, opts.MaxConsoleEntries, opts.MaxConsoleLength)
+	if err != nil {
+		return nil, err
 	}
-	if err := client.Emulation.SetVisibleSize(ctx, &emulation.SetVisibleSizeArgs{
-		Width:  width,
-		Height: height,
+	defer console.Close()
+
+	var har *HARRecorder
+	if opts.HAR {
+		har, err = NewHARRecorder(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		defer har.Close()
+	}
+
+	if opts.Performance {
+		if err := enablePerformance(ctx, client); err != nil {
+			return nil, err
+		}
+	}
+
+	// Prepare the viewport.
+	if err := setViewport(ctx, client, Viewport{
+		Width:  opts.Width,
+		Height: opts.Height,
 	}); err != nil {
-		return nil, errors.Wrap(err, "unable to set the initial visible size")
+		return nil, errors.Wrap(err, "unable to set the initial viewport")
 	}
 
 	log.Print("Set the page size")
 
+	if err := emulateMedia(ctx, client, opts.Conn, opts.Media, opts.MediaFeatures); err != nil {
+		return nil, err
+	}
+	if err := emulateTimezone(ctx, client, opts.Conn, opts.Timezone); err != nil {
+		return nil, err
+	}
+	if err := emulateLocale(ctx, client, opts.Conn, opts.Locale); err != nil {
+		return nil, err
+	}
+	if opts.Geolocation != nil && opts.HTML != "" {
+		return nil, errors.New("the geolocation can't be granted to inline html, which has no origin")
+	}
+	if err := emulateGeolocation(ctx, client, opts.Conn, opts.Geolocation, opts.URL, opts.BrowserContext); err != nil {
+		return nil, err
+	}
+
+	var det *determinism
+	if opts.Deterministic != nil {
+		det, err = prepareDeterministic(ctx, client, opts.Deterministic)
+		if err != nil {
+			return nil, err
+		}
+		defer det.Close()
+	}
+
+	url := opts.URL
+	if opts.HTML != "" {
+		switch opts.HTMLMode {
+		case "", HTMLModeDocument:
+			url = "about:blank"
+		case HTMLModeData:
+			url = DataURL(opts.HTML, opts.BaseURL)
+		default:
+			return nil, errors.Errorf("invalid html mode %q", opts.HTMLMode)
+		}
+	}
+
+	// The inline document fires load once its subresources are there, the
+	// listener has to exist before about:blank loads to tell them apart
+	var load page.LoadEventFiredClient
+	if opts.HTML != "" && url == "about:blank" {
+		load, err = client.Page.LoadEventFired(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to setup a listener to LoadEventFired")
+		}
+		defer load.Close()
+	}
+
 	// Create the Navigate arguments with the optional Referrer field set.
 	navArgs := page.NewNavigateArgs(url)
-	if _, err := client.Page.Navigate(ctx, navArgs); err != nil {
+	nav, err := client.Page.Navigate(ctx, navArgs)
+	if err != nil {
 		return nil, errors.Wrap(err, "unable to navigate to the page")
 	}
 
@@ -70,59 +270,255 @@ func TakeScreenshot(
 		return nil, errors.Wrap(err, "unable to wait for the content to load")
 	}
 
+	if load != nil {
+		if _, err := load.Recv(); err != nil {
+			return nil, errors.Wrap(err, "unable to wait for about:blank to load")
+		}
+		if err := client.Page.SetDocumentContent(ctx, page.NewSetDocumentContentArgs(
+			nav.FrameID, WithBaseURL(opts.HTML, opts.BaseURL),
+		)); err != nil {
+			return nil, errors.Wrap(err, "unable to set the document content")
+		}
+		if _, err := load.Recv(); err != nil {
+			return nil, errors.Wrap(err, "unable to wait for the document content to load")
+		}
+	}
+
+	if det != nil {
+		if err := det.wait(ctx, client); err != nil {
+			return nil, err
+		}
+	}
+
 	log.Print("Navigated to the page")
 
-	if delay != 0 {
-		time.Sleep(delay)
+	if opts.Delay != 0 {
+		time.Sleep(opts.Delay)
 	}
 
-	if fullPage {
-		// Fetch the document root node. We can pass nil here
-		// since this method only takes optional arguments.
-		doc, err := client.DOM.GetDocument(ctx, nil)
+	// Measure the page as loaded, before it's resized for the capture.
+	var perf *Performance
+	if opts.Performance {
+		perf, err = CollectPerformance(ctx, client)
 		if err != nil {
-			return nil, errors.Wrap(err, "uanble to get the DOM document")
+			return nil, err
 		}
+	}
 
-		// Select the body element to figure out its height
-		qsReply, err := client.DOM.QuerySelector(ctx, &dom.QuerySelectorArgs{
-			Selector: "body",
-			NodeID:   doc.Root.NodeID,
-		})
+	format := opts.Format
+	if format == "" {
+		format = "png"
+	}
+
+	var (
+		steps         []StepResult
+		stepArtifacts []Artifact
+	)
+	if len(opts.Steps) > 0 {
+		steps, stepArtifacts, err = runSteps(ctx, client, opts, format)
 		if err != nil {
-			return nil, errors.Wrap(err, "unable to find the body element")
+			return nil, err
+		}
+	}
+
+	if opts.FullPage && len(opts.Viewports) == 0 {
+		if opts.LazyLoad != nil {
+			if err := triggerLazyLoad(ctx, client, opts.LazyLoad); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := fitViewport(ctx, client, Viewport{
+			Width:       opts.Width,
+			ScaleFactor: 1,
+		}); err != nil {
+			return nil, err
 		}
+	}
+
+	var result *Result
+	switch {
+	case opts.Animation != nil:
+		maxWidth, maxHeight := opts.Width, opts.Height
+		if opts.Scaling != 0 && opts.Scaling != 1 {
+			maxWidth = int(float64(maxWidth) * opts.Scaling)
+			maxHeight = int(float64(maxHeight) * opts.Scaling)
+		}
+
+		result, err = recordAnimation(ctx, client, opts.Animation, maxWidth, maxHeight)
+	case len(opts.Viewports) > 0:
+		var artifacts []Artifact
+		artifacts, err = captureViewports(ctx, client, opts, format)
+		result = &Result{
+			Format:    format,
+			Captures:  len(artifacts),
+			Artifacts: artifacts,
+		}
+	default:
+		result, err = captureScreenshot(ctx, client, opts, format)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		// Get body's size
-		bmReply, err := client.DOM.GetBoxModel(ctx, &dom.GetBoxModelArgs{
-			NodeID: &qsReply.NodeID,
+	result.Steps = steps
+	result.Captures += len(stepArtifacts)
+	result.Artifacts = append(stepArtifacts, result.Artifacts...)
+
+	if err := archivePage(ctx, client, opts, result); err != nil {
+		return nil, err
+	}
+
+	if har != nil {
+		data, err := har.MarshalHAR()
+		if err != nil {
+			return nil, err
+		}
+		result.Artifacts = append(result.Artifacts, Artifact{
+			Name:        "page.har",
+			ContentType: "application/json",
+			Data:        data,
 		})
+	}
+
+	if interceptor != nil {
+		result.BlockedRequests = interceptor.Blocked()
+		result.DeniedRequests = interceptor.Denied()
+	}
+
+	result.Performance = perf
+	result.Dialogs = dialogs.Dialogs()
+	result.Console = console.Log()
+	if opts.FailOnException && result.Console != nil && len(result.Console.Exceptions) > 0 {
+		return nil, errors.Errorf("the page threw an uncaught exception: %s", result.Console.Exceptions[0].Text)
+	}
+
+	return result, nil
+}
+
+// captureScreenshot captures the viewport and runs the requested analyses of
+// the image.
+func captureScreenshot(ctx context.Context, client *cdp.Client, opts *Options, format string) (*Result, error) {
+	data, err := captureImage(ctx, client, format, opts.Quality, opts.Width, opts.Scaling)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		Data:     data,
+		Format:   format,
+		Captures: 1,
+	}
+
+	var img image.Image
+	if opts.Comparison != nil || opts.Fingerprint {
+		img, _, err = image.Decode(bytes.NewReader(data))
 		if err != nil {
-			return nil, errors.Wrap(err, "unable to get body's box model")
+			return nil, errors.Wrap(err, "unable to parse the screenshot")
 		}
+	}
 
-		// And prepare the final viewport
-		if err := client.Emulation.SetDeviceMetricsOverride(ctx, &emulation.SetDeviceMetricsOverrideArgs{
-			Width:             width,
-			Height:            bmReply.Model.Height,
-			DeviceScaleFactor: 1,
-			Mobile:            false,
-		}); err != nil {
-			return nil, errors.Wrap(err, "unable to set the final viewport size")
+	if opts.Fingerprint {
+		result.Fingerprint = NewFingerprint(img)
+	}
+
+	if opts.Comparison != nil {
+		comparison, diff, err := compareCapture(img, opts.Comparison)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to compare the screenshot")
 		}
-		if err := client.Emulation.SetVisibleSize(ctx, &emulation.SetVisibleSizeArgs{
-			Width:  width,
-			Height: bmReply.Model.Height,
-		}); err != nil {
-			return nil, errors.Wrap(err, "unable to set the final visible size")
+
+		log.Printf("Compared the screenshot, %.2f%% mismatched", comparison.Mismatch)
+
+		result.Comparison = comparison
+		result.Artifacts = append(result.Artifacts, Artifact{
+			Name:        "diff.png",
+			Label:       "diff",
+			ContentType: "image/png",
+			Data:        diff,
+		})
+	}
+
+	return result, nil
+}
+
+// archivePage adds the serialized DOM and the web archive to the artifacts
+// if requested.
+func archivePage(ctx context.Context, client *cdp.Client, opts *Options, result *Result) error {
+	if !opts.SerializedDOM && !opts.MHTML {
+		return nil
+	}
+
+	document, err := SerializeDOM(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	if opts.SerializedDOM {
+		result.Artifacts = append(result.Artifacts, Artifact{
+			Name:        "dom.html",
+			ContentType: "text/html; charset=utf-8",
+			Data:        []byte(document),
+		})
+	}
+
+	if opts.MHTML {
+		archive, err := BuildMHTML(ctx, client, document)
+		if err != nil {
+			return err
 		}
+		result.Artifacts = append(result.Artifacts, Artifact{
+			Name:        "page.mhtml",
+			ContentType: "application/x-mimearchive",
+			Data:        archive,
+		})
 	}
 
+	log.Print("Archived the page")
+
+	return nil
+}
+
+// fitViewport resizes the viewport to the height of the body element.
+func fitViewport(ctx context.Context, client *cdp.Client, vp Viewport) error {
+	// Fetch the document root node. We can pass nil here
+	// since this method only takes optional arguments.
+	doc, err := client.DOM.GetDocument(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "uanble to get the DOM document")
+	}
+
+	// Select the body element to figure out its height
+	qsReply, err := client.DOM.QuerySelector(ctx, &dom.QuerySelectorArgs{
+		Selector: "body",
+		NodeID:   doc.Root.NodeID,
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to find the body element")
+	}
+
+	// Get body's size
+	bmReply, err := client.DOM.GetBoxModel(ctx, &dom.GetBoxModelArgs{
+		NodeID: &qsReply.NodeID,
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to get body's box model")
+	}
+
+	// And prepare the final viewport
+	vp.Height = bmReply.Model.Height
+	if err := setViewport(ctx, client, vp); err != nil {
+		return errors.Wrap(err, "unable to set the final viewport")
+	}
+
+	return nil
+}
+
+// captureImage takes a screenshot of the current viewport and scales it down
+// to width*scaling if needed.
+func captureImage(ctx context.Context, client *cdp.Client, format string, quality, width int, scaling float64) ([]byte, error) {
 	// Capture a screenshot of the current page.
 	screenshotArgs := page.NewCaptureScreenshotArgs()
-	if format == "" {
-		format = "png"
-	}
 	screenshotArgs = screenshotArgs.SetFormat(format)
 
 	if format == "jpeg" && quality != 0 {
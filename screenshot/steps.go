@@ -0,0 +1,376 @@
+package screenshot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mafredri/cdp"
+	"github.com/mafredri/cdp/protocol/dom"
+	"github.com/mafredri/cdp/protocol/input"
+	"github.com/mafredri/cdp/protocol/runtime"
+	"github.com/pkg/errors"
+)
+
+// Actions of a Step.
+const (
+	StepClick    = "click"     // clicks the center of Selector
+	StepType     = "type"      // focuses Selector and types Text
+	StepPress    = "press"     // presses Key, eg. Enter or ArrowDown
+	StepHover    = "hover"     // moves the mouse over Selector
+	StepScrollTo = "scroll_to" // scrolls Selector into view, or the page to X, Y
+	StepWaitFor  = "wait_for"  // waits until Selector matches an element
+	StepWait     = "wait"      // waits for Duration
+	StepEvaluate = "evaluate"  // evaluates Script, awaiting a returned promise
+)
+
+// DefaultStepTimeout limits a Step without a timeout.
+const DefaultStepTimeout = 5 * time.Second
+
+// Step is a single interaction with the page before it's captured.
+type Step struct {
+	Action   string `json:"action"`
+	Selector string `json:"selector,omitempty"`
+	Text     string `json:"text,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Script   string `json:"script,omitempty"`
+	X        int    `json:"x,omitempty"`
+	Y        int    `json:"y,omitempty"`
+	Duration int64  `json:"duration,omitempty"` // in ms
+	Timeout  int64  `json:"timeout,omitempty"`  // in ms, DefaultStepTimeout if 0
+	Capture  bool   `json:"capture,omitempty"`  // capture the viewport after the step
+	Label    string `json:"label,omitempty"`    // of the captured image, step-<n> by default
+}
+
+// StepResult reports how a step went. The steps after a failed one are
+// not run.
+type StepResult struct {
+	Index   int             `json:"index"`
+	Action  string          `json:"action"`
+	Elapsed float64         `json:"elapsed"` // in ms
+	Error   string          `json:"error,omitempty"`
+	Value   json.RawMessage `json:"value,omitempty"`   // returned by an evaluate step
+	Capture string          `json:"capture,omitempty"` // name of the captured image
+}
+
+// keyDefinition describes a named key for Input.dispatchKeyEvent.
+type keyDefinition struct {
+	code    string
+	keyCode int
+	text    string
+}
+
+var keyDefinitions = map[string]keyDefinition{
+	"Enter":      {"Enter", 13, "\r"},
+	"Tab":        {"Tab", 9, ""},
+	"Escape":     {"Escape", 27, ""},
+	"Backspace":  {"Backspace", 8, ""},
+	"Delete":     {"Delete", 46, ""},
+	"Space":      {"Space", 32, " "},
+	"ArrowUp":    {"ArrowUp", 38, ""},
+	"ArrowDown":  {"ArrowDown", 40, ""},
+	"ArrowLeft":  {"ArrowLeft", 37, ""},
+	"ArrowRight": {"ArrowRight", 39, ""},
+	"Home":       {"Home", 36, ""},
+	"End":        {"End", 35, ""},
+	"PageUp":     {"PageUp", 33, ""},
+	"PageDown":   {"PageDown", 34, ""},
+}
+
+// Validate checks that the step has what its action needs.
+func (s *Step) Validate() error {
+	switch s.Action {
+	case StepClick, StepType, StepHover, StepWaitFor:
+		if s.Selector == "" {
+			return errors.Errorf("the %s step needs a selector", s.Action)
+		}
+	case StepPress:
+		if _, ok := keyDefinitions[s.Key]; !ok && len([]rune(s.Key)) != 1 {
+			return errors.Errorf("unknown key %q", s.Key)
+		}
+	case StepScrollTo, StepWait:
+	case StepEvaluate:
+		if s.Script == "" {
+			return errors.New("the evaluate step needs a script")
+		}
+	default:
+		return errors.Errorf("unknown step action %q", s.Action)
+	}
+	if s.Duration < 0 || s.Timeout < 0 {
+		return errors.New("the step durations can't be negative")
+	}
+	if s.Label != "" && !labelPattern.MatchString(s.Label) {
+		return errors.Errorf("invalid step label %q, expected up to 64 letters, digits, dashes or underscores", s.Label)
+	}
+	return nil
+}
+
+// Name returns the label of the i-th step, step-<i> when it has none.
+func (s *Step) Name(i int) string {
+	if s.Label == "" {
+		return fmt.Sprintf("step-%d", i)
+	}
+	return s.Label
+}
+
+// runSteps runs the steps in order until one fails and returns their reports
+// along with the captured images. Only running out of time fails the capture.
+func runSteps(ctx context.Context, client *cdp.Client, opts *Options, format string) ([]StepResult, []Artifact, error) {
+	var (
+		reports   []StepResult
+		artifacts []Artifact
+	)
+	for i, step := range opts.Steps {
+		report := StepResult{
+			Index:  i,
+			Action: step.Action,
+		}
+
+		start := time.Now()
+		value, err := runStep(ctx, client, &step)
+		report.Elapsed = float64(time.Since(start)) / float64(time.Millisecond)
+		report.Value = value
+
+		if err == nil && step.Capture {
+			label := step.Name(i)
+
+			var data []byte
+			data, err = captureImage(ctx, client, format, opts.Quality, opts.Width, opts.Scaling)
+			if err == nil {
+				report.Capture = label + "." + format
+				artifacts = append(artifacts, Artifact{
+					Name:        report.Capture,
+					Label:       label,
+					ContentType: "image/" + format,
+					Data:        data,
+				})
+			}
+		}
+
+		if err != nil {
+			report.Error = err.Error()
+			reports = append(reports, report)
+
+			log.Printf("Step %d (%s) failed: %v", i, step.Action, err)
+
+			// The main context has expired, there's no point capturing
+			if ctx.Err() != nil {
+				return nil, nil, errors.Wrapf(err, "step %d (%s) failed", i, step.Action)
+			}
+			return reports, artifacts, nil
+		}
+		reports = append(reports, report)
+	}
+
+	log.Printf("Ran %d steps", len(opts.Steps))
+
+	return reports, artifacts, nil
+}
+
+// MaxDuration returns the longest time the step can take.
+func (s *Step) MaxDuration() time.Duration {
+	timeout := DefaultStepTimeout
+	if s.Timeout > 0 {
+		timeout = time.Duration(s.Timeout) * time.Millisecond
+	}
+	if s.Action == StepWait && s.Timeout == 0 {
+		// A long wait isn't cut short by the default timeout
+		timeout += time.Duration(s.Duration) * time.Millisecond
+	}
+	return timeout
+}
+
+func runStep(ctx context.Context, client *cdp.Client, step *Step) (json.RawMessage, error) {
+	if err := step.Validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, step.MaxDuration())
+	defer cancel()
+
+	switch step.Action {
+	case StepClick, StepHover:
+		node, err := waitForNode(ctx, client, step.Selector)
+		if err != nil {
+			return nil, err
+		}
+		x, y, err := nodeCenter(ctx, client, node)
+		if err != nil {
+			return nil, err
+		}
+		if step.Action == StepHover {
+			return nil, mouseEvent(ctx, client, "mouseMoved", x, y)
+		}
+		for _, typ := range []string{"mouseMoved", "mousePressed", "mouseReleased"} {
+			if err := mouseEvent(ctx, client, typ, x, y); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+
+	case StepType:
+		node, err := waitForNode(ctx, client, step.Selector)
+		if err != nil {
+			return nil, err
+		}
+		if err := client.DOM.Focus(ctx, &dom.FocusArgs{NodeID: &node}); err != nil {
+			return nil, errors.Wrap(err, "unable to focus the element")
+		}
+		for _, r := range step.Text {
+			key := string(r)
+			if r == '\n' {
+				key = "Enter"
+			}
+			if err := pressKey(ctx, client, key); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+
+	case StepPress:
+		return nil, pressKey(ctx, client, step.Key)
+
+	case StepScrollTo:
+		if step.Selector == "" {
+			return nil, evaluate(ctx, client, fmt.Sprintf("window.scrollTo(%d, %d)", step.X, step.Y), nil)
+		}
+		node, err := waitForNode(ctx, client, step.Selector)
+		if err != nil {
+			return nil, err
+		}
+		return nil, scrollIntoView(ctx, client, node)
+
+	case StepWaitFor:
+		_, err := waitForNode(ctx, client, step.Selector)
+		return nil, err
+
+	case StepWait:
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "the wait exceeded the step timeout")
+		case <-time.After(time.Duration(step.Duration) * time.Millisecond):
+			return nil, nil
+		}
+
+	case StepEvaluate:
+		var value json.RawMessage
+		if err := evaluate(ctx, client, step.Script, &value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+	return nil, nil
+}
+
+// waitForNode polls for an element matching the selector until the context
+// expires.
+func waitForNode(ctx context.Context, client *cdp.Client, selector string) (dom.NodeID, error) {
+	for {
+		doc, err := client.DOM.GetDocument(ctx, nil)
+		if err != nil {
+			return 0, errors.Wrap(err, "unable to get the DOM document")
+		}
+		reply, err := client.DOM.QuerySelector(ctx, &dom.QuerySelectorArgs{
+			Selector: selector,
+			NodeID:   doc.Root.NodeID,
+		})
+		if err != nil {
+			return 0, errors.Wrapf(err, "unable to query %q", selector)
+		}
+		if reply.NodeID != 0 {
+			return reply.NodeID, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, errors.Errorf("no element matches %q", selector)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// scrollIntoView scrolls the element to the center of the viewport.
+func scrollIntoView(ctx context.Context, client *cdp.Client, node dom.NodeID) error {
+	resolved, err := client.DOM.ResolveNode(ctx, &dom.ResolveNodeArgs{NodeID: &node})
+	if err != nil {
+		return errors.Wrap(err, "unable to resolve the element")
+	}
+	if resolved.Object.ObjectID == nil {
+		return errors.New("the element has no javascript object")
+	}
+
+	reply, err := client.Runtime.CallFunctionOn(ctx, runtime.NewCallFunctionOnArgs(
+		`function() { this.scrollIntoView({block: 'center', inline: 'center'}); }`,
+	).SetObjectID(*resolved.Object.ObjectID))
+	if err != nil {
+		return errors.Wrap(err, "unable to scroll to the element")
+	}
+	if reply.ExceptionDetails != nil {
+		return errors.Errorf("unable to scroll to the element: %s", reply.ExceptionDetails.Text)
+	}
+
+	return waitForLayout(ctx, client)
+}
+
+// nodeCenter scrolls the element into view and returns the center of its
+// content box in the viewport.
+func nodeCenter(ctx context.Context, client *cdp.Client, node dom.NodeID) (float64, float64, error) {
+	if err := scrollIntoView(ctx, client, node); err != nil {
+		return 0, 0, err
+	}
+
+	reply, err := client.DOM.GetBoxModel(ctx, &dom.GetBoxModelArgs{NodeID: &node})
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "unable to get the box model of the element")
+	}
+
+	quad := reply.Model.Content
+	if len(quad) != 8 {
+		return 0, 0, errors.New("the element has no box")
+	}
+	return (quad[0] + quad[2] + quad[4] + quad[6]) / 4, (quad[1] + quad[3] + quad[5] + quad[7]) / 4, nil
+}
+
+func mouseEvent(ctx context.Context, client *cdp.Client, typ string, x, y float64) error {
+	args := input.NewDispatchMouseEventArgs(typ, x, y)
+	if typ != "mouseMoved" {
+		args = args.SetButton("left").SetClickCount(1)
+	}
+	if err := client.Input.DispatchMouseEvent(ctx, args); err != nil {
+		return errors.Wrapf(err, "unable to dispatch %s", typ)
+	}
+	return nil
+}
+
+// pressKey presses and releases a named key or types a single character.
+func pressKey(ctx context.Context, client *cdp.Client, key string) error {
+	def, ok := keyDefinitions[key]
+	if !ok {
+		def = keyDefinition{text: key}
+	}
+	if key == "Space" {
+		key = " "
+	}
+
+	down := input.NewDispatchKeyEventArgs("keyDown").SetKey(key)
+	up := input.NewDispatchKeyEventArgs("keyUp").SetKey(key)
+	if def.code != "" {
+		down = down.SetCode(def.code).SetWindowsVirtualKeyCode(def.keyCode)
+		up = up.SetCode(def.code).SetWindowsVirtualKeyCode(def.keyCode)
+	}
+	if def.text != "" {
+		down = down.SetText(def.text).SetUnmodifiedText(def.text)
+	} else {
+		down.Type = "rawKeyDown"
+	}
+
+	if err := client.Input.DispatchKeyEvent(ctx, down); err != nil {
+		return errors.Wrapf(err, "unable to press %q", key)
+	}
+	if err := client.Input.DispatchKeyEvent(ctx, up); err != nil {
+		return errors.Wrapf(err, "unable to release %q", key)
+	}
+	return nil
+}
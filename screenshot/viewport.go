@@ -0,0 +1,105 @@
+package screenshot
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strconv"
+
+	"github.com/mafredri/cdp"
+	"github.com/mafredri/cdp/protocol/emulation"
+	"github.com/pkg/errors"
+)
+
+// Viewport is a single breakpoint of a responsive capture.
+type Viewport struct {
+	Label       string  `json:"label"`        // the width by default
+	Width       int     `json:"width"`        // required
+	Height      int     `json:"height"`       // the height of the capture by default
+	ScaleFactor float64 `json:"scale_factor"` // device scale factor, 0 keeps the default
+	Mobile      bool    `json:"mobile"`
+}
+
+// labelPattern restricts the labels of the viewports and the steps, which end
+// up in the names of the artifacts, the s3 keys and the multipart filenames.
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Validate checks the viewport before rendering.
+func (vp *Viewport) Validate() error {
+	if vp.Width <= 0 {
+		return errors.New("viewport width must be greater than 0")
+	}
+	if vp.Label != "" && !labelPattern.MatchString(vp.Label) {
+		return errors.Errorf("invalid viewport label %q, expected up to 64 letters, digits, dashes or underscores", vp.Label)
+	}
+	return nil
+}
+
+// Name returns the label of the viewport, its width when it has none.
+func (vp *Viewport) Name() string {
+	if vp.Label == "" {
+		return strconv.Itoa(vp.Width)
+	}
+	return vp.Label
+}
+
+func setViewport(ctx context.Context, client *cdp.Client, vp Viewport) error {
+	if err := client.Emulation.SetDeviceMetricsOverride(ctx, &emulation.SetDeviceMetricsOverrideArgs{
+		Width:             vp.Width,
+		Height:            vp.Height,
+		DeviceScaleFactor: vp.ScaleFactor,
+		Mobile:            vp.Mobile,
+	}); err != nil {
+		return errors.Wrap(err, "unable to set the viewport size")
+	}
+	if err := client.Emulation.SetVisibleSize(ctx, &emulation.SetVisibleSizeArgs{
+		Width:  vp.Width,
+		Height: vp.Height,
+	}); err != nil {
+		return errors.Wrap(err, "unable to set the visible size")
+	}
+	return nil
+}
+
+// captureViewports captures the already loaded page once per viewport,
+// waiting for the page to be laid out again after every resize.
+func captureViewports(ctx context.Context, client *cdp.Client, opts *Options, format string) ([]Artifact, error) {
+	var artifacts []Artifact
+	for _, vp := range opts.Viewports {
+		if err := vp.Validate(); err != nil {
+			return nil, err
+		}
+		if vp.Height <= 0 {
+			vp.Height = opts.Height
+		}
+		vp.Label = vp.Name()
+
+		if err := setViewport(ctx, client, vp); err != nil {
+			return nil, errors.Wrapf(err, "viewport %s", vp.Label)
+		}
+		if err := waitForLayout(ctx, client); err != nil {
+			return nil, errors.Wrapf(err, "viewport %s", vp.Label)
+		}
+
+		if opts.FullPage {
+			if err := fitViewport(ctx, client, vp); err != nil {
+				return nil, errors.Wrapf(err, "viewport %s", vp.Label)
+			}
+		}
+
+		data, err := captureImage(ctx, client, format, opts.Quality, vp.Width, opts.Scaling)
+		if err != nil {
+			return nil, errors.Wrapf(err, "viewport %s", vp.Label)
+		}
+
+		log.Printf("Captured the %s viewport", vp.Label)
+
+		artifacts = append(artifacts, Artifact{
+			Name:        vp.Label + "." + format,
+			Label:       vp.Label,
+			ContentType: "image/" + format,
+			Data:        data,
+		})
+	}
+	return artifacts, nil
+}
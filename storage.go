@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+
+	"github.com/minio/minio-go"
+	"github.com/pkg/errors"
+
+	"github.com/reinho/cdp-screenshots/screenshot"
+)
+
+// upload stores the data in the s3 bucket along with the user metadata and
+// returns its public URL.
+func upload(key, contentType string, data []byte, metadata map[string]string) (string, error) {
+	if _, err := s3Service.PutObject(
+		*s3Bucket,
+		key,
+		bytes.NewReader(data),
+		int64(len(data)),
+		minio.PutObjectOptions{
+			ContentType:  contentType,
+			UserMetadata: metadata,
+		},
+	); err != nil {
+		return "", errors.Wrapf(err, "unable to upload %s to s3", key)
+	}
+
+	return *s3BasePath + "/" + key, nil
+}
+
+// download fetches an object from the s3 bucket.
+func download(key string) ([]byte, error) {
+	object, err := s3Service.GetObject(*s3Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get %s from s3", key)
+	}
+	defer object.Close()
+
+	data, err := ioutil.ReadAll(object)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to download %s from s3", key)
+	}
+	return data, nil
+}
+
+// uploadArtifacts stores the artifacts next to the image with the given key
+// prefix and returns their URLs by name.
+func uploadArtifacts(prefix string, artifacts []screenshot.Artifact) (map[string]string, error) {
+	if len(artifacts) == 0 {
+		return nil, nil
+	}
+
+	urls := map[string]string{}
+	for _, artifact := range artifacts {
+		url, err := upload(prefix+"-"+artifact.Name, artifact.ContentType, artifact.Data, nil)
+		if err != nil {
+			return nil, err
+		}
+		urls[artifact.Name] = url
+	}
+	return urls, nil
+}
+
+// imageMetadata returns the s3 user metadata of the main image.
+func imageMetadata(result *screenshot.Result) map[string]string {
+	if result.Fingerprint == nil {
+		return nil
+	}
+
+	return map[string]string{
+		"ahash":         result.Fingerprint.AHash,
+		"dhash":         result.Fingerprint.DHash,
+		"phash":         result.Fingerprint.PHash,
+		"average-color": result.Fingerprint.AverageColor,
+		"palette":       strings.Join(result.Fingerprint.Palette, ","),
+	}
+}
+
+func imageContentType(format string) string {
+	switch format {
+	case "png":
+		return "image/png"
+	case "gif":
+		return "image/gif"
+	default:
+		return "image/jpeg"
+	}
+}
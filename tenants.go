@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/benmanns/goworker"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+
+	"github.com/reinho/cdp-screenshots/screenshot"
+)
+
+// usageRetention is how long the daily usage counters of the tenants are
+// kept.
+const usageRetention = 8 * 24 * time.Hour
+
+// Tenant is a team sharing the renderer, identified by the tenant field of
+// the jobs and by its API keys on the http server. Zero limits are
+// unlimited.
+type Tenant struct {
+	Name          string   `json:"name"`
+	APIKeys       []string `json:"api_keys,omitempty"`
+	RatePerMinute int      `json:"rate_per_minute"` // jobs started per minute
+	MaxConcurrent int      `json:"max_concurrent"`  // jobs running at once
+	DailyCaptures int64    `json:"daily_captures"`  // images per UTC day
+	DailyBytes    int64    `json:"daily_bytes"`     // output bytes per UTC day
+}
+
+// tenantUsage is the usage of a tenant in a day, served at /usage.
+type tenantUsage struct {
+	Tenant string           `json:"tenant"`
+	Date   string           `json:"date"`
+	Usage  map[string]int64 `json:"usage"`
+	Limits *Tenant          `json:"limits"`
+}
+
+// Counters of the tenant usage.
+const (
+	usageJobs      = "jobs"
+	usageCaptures  = "captures"
+	usageBytes     = "bytes"
+	usageFailed    = "failed"
+	usageCancelled = "cancelled"
+	usageRejected  = "rejected"
+)
+
+// tenants are loaded from tenants_file, nil when the tenants are disabled
+// and every job may run.
+var (
+	tenants       map[string]*Tenant
+	tenantAPIKeys map[string]*Tenant
+)
+
+// quotaError rejects a job of a tenant which used up its daily quota.
+type quotaError struct {
+	tenant string
+	quota  string
+}
+
+func (e *quotaError) Error() string {
+	return "the tenant " + e.tenant + " exceeded its daily quota of " + e.quota
+}
+
+// errTenantBusy defers a job of a tenant at its rate limit or at its cap of
+// concurrent jobs.
+var errTenantBusy = errors.New("the tenant is at its rate or concurrency limit")
+
+// loadTenants reads the JSON list of tenants.
+func loadTenants(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "unable to read the tenants")
+	}
+	var list []*Tenant
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.Wrap(err, "unable to decode the tenants")
+	}
+
+	byName := map[string]*Tenant{}
+	byKey := map[string]*Tenant{}
+	for _, t := range list {
+		if !jobIDPattern.MatchString(t.Name) {
+			return errors.Errorf("invalid tenant name %q", t.Name)
+		}
+		if _, ok := byName[t.Name]; ok {
+			return errors.Errorf("the tenant %s is listed twice", t.Name)
+		}
+		if t.RatePerMinute < 0 || t.MaxConcurrent < 0 || t.DailyCaptures < 0 || t.DailyBytes < 0 {
+			return errors.Errorf("the limits of the tenant %s can't be negative", t.Name)
+		}
+		byName[t.Name] = t
+
+		for _, key := range t.APIKeys {
+			if key == "" {
+				return errors.Errorf("the tenant %s has an empty api key", t.Name)
+			}
+			if _, ok := byKey[key]; ok {
+				return errors.Errorf("an api key of the tenant %s is already used", t.Name)
+			}
+			byKey[key] = t
+		}
+	}
+
+	tenants, tenantAPIKeys = byName, byKey
+
+	log.Printf("Loaded %d tenants from %s", len(byName), path)
+	return nil
+}
+
+// findTenant returns the tenant a job belongs to. Without tenants configured
+// it returns nil for every job, with them a job has to name a known tenant.
+func findTenant(name string) (*Tenant, error) {
+	if tenants == nil {
+		return nil, nil
+	}
+	if name == "" {
+		return nil, errors.New("the job names no tenant")
+	}
+	t, ok := tenants[name]
+	if !ok {
+		return nil, errors.Errorf("unknown tenant %s", name)
+	}
+	return t, nil
+}
+
+// tenantByAPIKey returns the name of the tenant owning the API key.
+func tenantByAPIKey(key string) (string, bool) {
+	t, ok := tenantAPIKeys[key]
+	if !ok {
+		return "", false
+	}
+	return t.Name, true
+}
+
+func tenantKey(name, suffix string) string {
+	return *redisNamespace + "tenant:" + name + ":" + suffix
+}
+
+func usageDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// admitScript checks the daily quotas, the rate limit and the concurrent jobs
+// of a tenant and takes a slot for the job, all at once so that the workers
+// don't race each other.
+//
+// KEYS: usage hash, rate counter, running jobs set
+// ARGV: now, deadline of the job, job id, captures of the job, and the
+// daily captures, daily bytes, rate per minute and concurrency limits
+var admitScript = redis.NewScript(3, `
+local usage = redis.call('HMGET', KEYS[1], 'captures', 'bytes')
+local captures = tonumber(usage[1] or '0')
+local bytes = tonumber(usage[2] or '0')
+if tonumber(ARGV[5]) > 0 and captures + tonumber(ARGV[4]) > tonumber(ARGV[5]) then
+	return 'captures'
+end
+if tonumber(ARGV[6]) > 0 and bytes >= tonumber(ARGV[6]) then
+	return 'bytes'
+end
+if tonumber(ARGV[7]) > 0 and tonumber(redis.call('GET', KEYS[2]) or '0') >= tonumber(ARGV[7]) then
+	return 'rate'
+end
+if tonumber(ARGV[8]) > 0 then
+	redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', ARGV[1])
+	if redis.call('ZCARD', KEYS[3]) >= tonumber(ARGV[8]) then
+		return 'concurrency'
+	end
+	redis.call('ZADD', KEYS[3], ARGV[2], ARGV[3])
+	redis.call('EXPIRE', KEYS[3], 86400)
+end
+if tonumber(ARGV[7]) > 0 then
+	redis.call('INCR', KEYS[2])
+	redis.call('EXPIRE', KEYS[2], 120)
+end
+return 'ok'
+`)
+
+// admit lets a job of the tenant producing the number of captures run for at
+// most the timeout. It returns a quotaError when the job has to be rejected
+// and errTenantBusy when it has to wait. Call release once the job is over.
+func (t *Tenant) admit(jobID string, captures int, timeout time.Duration) (release func(), err error) {
+	conn, err := goworker.GetConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get a redis connection")
+	}
+	defer goworker.PutConn(conn)
+
+	now := time.Now()
+	running := tenantKey(t.Name, "running")
+	verdict, err := redis.String(admitScript.Do(conn.Conn,
+		tenantKey(t.Name, "usage:"+usageDate(now)),
+		tenantKey(t.Name, "rate:"+strconv.FormatInt(now.Unix()/60, 10)),
+		running,
+		now.Unix(),
+		now.Add(timeout).Unix()+1,
+		jobID,
+		captures,
+		t.DailyCaptures,
+		t.DailyBytes,
+		t.RatePerMinute,
+		t.MaxConcurrent,
+	))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to check the limits of the tenant")
+	}
+
+	switch verdict {
+	case "ok":
+	case "captures", "bytes":
+		return nil, &quotaError{tenant: t.Name, quota: verdict}
+	default:
+		return nil, errTenantBusy
+	}
+
+	return func() {
+		if t.MaxConcurrent == 0 {
+			return
+		}
+		conn, err := goworker.GetConn()
+		if err != nil {
+			log.Printf("[%s] Unable to release the slot of the tenant %s: %v", jobID, t.Name, err)
+			return
+		}
+		defer goworker.PutConn(conn)
+		if _, err := conn.Do("ZREM", running, jobID); err != nil {
+			log.Printf("[%s] Unable to release the slot of the tenant %s: %v", jobID, t.Name, err)
+		}
+	}, nil
+}
+
+// admitTenant applies the limits of the tenant of the job, which produces the
+// number of captures. A job over the quota or of an unknown tenant is
+// rejected with a failure callback, a job of a busy tenant returns
+// errTenantBusy to be deferred. The tenant is nil without tenants
+// configured.
+func admitTenant(status *jobStatus, msg *Message, captures int, timeout time.Duration) (*Tenant, func(), error) {
+	tenant, err := findTenant(msg.Tenant)
+	if err != nil {
+		return nil, nil, rejectJob(status, msg.Callback, err)
+	}
+	if tenant == nil {
+		return nil, func() {}, nil
+	}
+
+	release, err := tenant.admit(status.ID, captures, timeout)
+	if err == errTenantBusy {
+		return nil, nil, err
+	}
+	if _, ok := err.(*quotaError); ok {
+		tenant.record(usageRejected, 1)
+		return nil, nil, rejectJob(status, msg.Callback, err)
+	}
+	if err != nil {
+		return nil, nil, status.fail(err)
+	}
+	return tenant, release, nil
+}
+
+// record adds n to a usage counter of the tenant for today.
+func (t *Tenant) record(counter string, n int64) {
+	if t == nil || n == 0 {
+		return
+	}
+
+	conn, err := goworker.GetConn()
+	if err != nil {
+		log.Printf("Unable to record the usage of the tenant %s: %v", t.Name, err)
+		return
+	}
+	defer goworker.PutConn(conn)
+
+	key := tenantKey(t.Name, "usage:"+usageDate(time.Now()))
+	conn.Send("MULTI")
+	conn.Send("HINCRBY", key, counter, n)
+	conn.Send("EXPIRE", key, int(usageRetention/time.Second))
+	if _, err := conn.Do("EXEC"); err != nil {
+		log.Printf("Unable to record the usage of the tenant %s: %v", t.Name, err)
+	}
+}
+
+// recordResult counts the rendered images and the output bytes of a result.
+func (t *Tenant) recordResult(result *screenshot.Result) {
+	if t == nil || result == nil {
+		return
+	}
+
+	size := int64(len(result.Data))
+	for _, artifact := range result.Artifacts {
+		size += int64(len(artifact.Data))
+	}
+	t.record(usageCaptures, int64(result.Captures))
+	t.record(usageBytes, size)
+}
+
+// loadUsage returns the usage of the tenant on the date.
+func loadUsage(name, date string) (*tenantUsage, error) {
+	t, ok := tenants[name]
+	if !ok {
+		return nil, nil
+	}
+
+	conn, err := goworker.GetConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get a redis connection")
+	}
+	defer goworker.PutConn(conn)
+
+	counters, err := redis.Int64Map(conn.Do("HGETALL", tenantKey(name, "usage:"+date)))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load the usage")
+	}
+
+	limits := *t
+	limits.APIKeys = nil
+	return &tenantUsage{
+		Tenant: name,
+		Date:   date,
+		Usage:  counters,
+		Limits: &limits,
+	}, nil
+}
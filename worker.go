@@ -1,167 +1,415 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/dchest/uniuri"
 	"github.com/mafredri/cdp"
 	"github.com/mafredri/cdp/devtool"
+	"github.com/mafredri/cdp/protocol/target"
 	"github.com/mafredri/cdp/rpcc"
-	"github.com/minio/minio-go"
 	"github.com/pkg/errors"
 
+	https "github.com/reinho/cdp-screenshots/http"
 	"github.com/reinho/cdp-screenshots/screenshot"
 )
 
 func screenshotWorker(queue string, args ...interface{}) error {
-	msgID := uniuri.New()
-
-	msg := &Message{
-		HTML:         args[0].(string),
-		URL:          args[1].(string),
-		Width:        mustInt64(args[2].(json.Number).Int64()),
-		Height:       mustInt64(args[3].(json.Number).Int64()),
-		Scaling:      mustFloat64(args[4].(json.Number).Float64()),
-		Delay:        mustInt64(args[5].(json.Number).Int64()),
-		FullPage:     args[6].(bool),
-		Format:       args[7].(string),
-		Quality:      mustInt64(args[8].(json.Number).Int64()),
-		Callback:     args[9].(string),
-		CallbackType: args[10].(string),
-	}
-
-	mainCtx, cancel := context.WithTimeout(context.Background(), time.Duration(msg.Delay)*time.Millisecond+*screenshotTimeout+*callbackTimeout)
+	msg, err := parseMessage(args)
+	if err != nil {
+		return rejectInvalid(msg, "Screenshot", queue, errors.Wrap(err, "invalid job arguments"))
+	}
+
+	msgID := msg.JobID
+	if msgID == "" {
+		msgID = uniuri.New()
+	}
+
+	if moved, err := routeJob(queue, msg.Queue, "Screenshot", args); err != nil || moved {
+		if moved && msg.JobID != "" {
+			newJobStatus(msgID, "Screenshot", msg.Queue, msg.Tenant).set(JobQueued)
+		}
+		return err
+	}
+
+	status := newJobStatus(msgID, "Screenshot", queue, msg.Tenant)
+	if dropCancelled(status, msg.JobID) {
+		return nil
+	}
+
+	renderTimeout, err := msg.RenderTimeout()
+	if err != nil {
+		return status.fail(err)
+	}
+
+	// Keep off the hosts at their limits, trying again after the other jobs
+	host, err := admitHost(msgID, msg, renderTimeout)
+	if err == errHostBusy {
+		return deferJob(status, msg.JobID, queue, "Screenshot", args, err)
+	}
+	if err != nil {
+		return status.fail(err)
+	}
+
+	// A job the tenant can't run yet gives the host its navigation back
+	tenant, releaseTenant, err := admitTenant(status, msg, msg.Captures(), renderTimeout+*callbackTimeout)
+	if err != nil {
+		host.refund()
+	}
+	if err == errTenantBusy {
+		return deferJob(status, msg.JobID, queue, "Screenshot", args, err)
+	}
+	if err != nil {
+		return err
+	}
+	defer host.release()
+	defer releaseTenant()
+
+	status.set(JobRunning)
+	tenant.record(usageJobs, 1)
+
+	mainCtx, cancel := context.WithTimeout(context.Background(), renderTimeout+*callbackTimeout)
 	defer cancel()
+	mainCtx, job, finish := startJob(mainCtx, msgID, msg.Tenant)
+	defer finish()
+
+	result, err := render(mainCtx, msgID, msg)
+	if err != nil {
+		err = errors.Wrap(err, "failed to take a screenshot")
+	} else if job.startDelivery() {
+		err = deliver(mainCtx, status, msg, result)
+	}
+	if job.Cancelled() {
+		log.Printf("[%s] Cancelled", msgID)
+		tenant.record(usageCancelled, 1)
+		status.set(JobCancelled)
+		return nil
+	}
+	if err != nil {
+		tenant.record(usageFailed, 1)
+		return status.fail(err)
+	}
+	tenant.recordResult(result)
+	status.set(JobDone)
+	return nil
+}
+
+// dropCancelled reports whether the job was cancelled while queued, marking
+// it as such. Only the jobs with a caller supplied ID can be cancelled
+// before they run.
+func dropCancelled(status *jobStatus, jobID string) bool {
+	if jobID == "" {
+		return false
+	}
+
+	cancelled, err := cancelRequested(jobID, status.Tenant)
+	if err != nil {
+		log.Printf("[%s] %+v", jobID, err)
+		return false
+	}
+	if cancelled {
+		log.Printf("[%s] Dropped the job cancelled while queued", jobID)
+		status.set(JobCancelled)
+		clearCancel(jobID, status.Tenant)
+	}
+	return cancelled
+}
+
+// render loads the page of the message in a new Chrome target and captures it.
+func render(mainCtx context.Context, msgID string, msg *Message) (*screenshot.Result, error) {
+	animation, err := msg.Animation()
+	if err != nil {
+		return nil, err
+	}
+	renderTimeout, err := msg.RenderTimeout()
+	if err != nil {
+		return nil, err
+	}
+	deterministic, err := msg.Determinism()
+	if err != nil {
+		return nil, err
+	}
+	comparison, err := msg.Comparison()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to prepare the comparison")
+	}
 
 	// First we need to prepare a URL to open
-	var targetURL string
-	if msg.HTML == "" {
+	var (
+		targetURL  string
+		inlineHTML string
+		inlineMode string
+		policy     *screenshot.NetworkPolicy
+	)
+	if *denyPrivateNetworks {
+		policy = &screenshot.NetworkPolicy{
+			AllowedHosts: splitList(*allowedHosts),
+		}
+	}
+	// The html is preferred, a message without either is rendered from its
+	// archive or assets
+	if msg.HTML == "" && msg.URL != "" {
 		targetURL = msg.URL
+
+		if policy != nil {
+			if err := policy.Check(mainCtx, targetURL); err != nil {
+				return nil, errors.Wrap(err, "the url is not allowed")
+			}
+		}
 	} else {
-		// Load it up into our HTTP server
-		id := uniuri.New()
-		httpServer.Set(id, msg.HTML)
-		defer httpServer.Delete(id)
-		targetURL = "http://127.0.0.1" + *httpBind + "/" + id
+		bundle, err := msg.Bundle()
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to prepare the html bundle")
+		}
+
+		if *htmlMode != "http" && len(bundle.Assets) == 0 && len(bundle.Headers) == 0 && msg.Geolocation == nil {
+			// Chrome loads the markup directly, no need for the server. The
+			// page has neither the response headers nor an origin then, which
+			// the geolocation is granted to.
+			inlineHTML, inlineMode = bundle.HTML, *htmlMode
+		} else {
+			bundle.Expires = time.Now().Add(*htmlTTL)
+
+			// Load it up into our HTTP server
+			id := https.NewKey()
+			httpServer.Set(id, bundle)
+			defer httpServer.Delete(id)
+			targetURL = httpServerURL() + "/" + id + "/"
+
+			if policy != nil {
+				policy.AllowedPrefixes = []string{targetURL}
+			}
+		}
 	}
 
-	log.Printf("[%s] Started processing %s", msgID, targetURL)
+	if inlineHTML != "" {
+		log.Printf("[%s] Started processing inline html in the %s mode", msgID, inlineMode)
+	} else {
+		log.Printf("[%s] Started processing %s", msgID, targetURL)
+	}
 
-	var (
-		err    error
-		result []byte
-	)
+	var result *screenshot.Result
 	chromeProcess.Execute(func() {
 		log.Printf("[%s] Acquired a Chrome process", msgID)
 
 		// remember to not shadow err! we are 100% sure we have chrome on :9222
-		ctx, screenshotCancel := context.WithTimeout(mainCtx, time.Duration(msg.Delay)*time.Millisecond+*screenshotTimeout)
+		ctx, screenshotCancel := context.WithTimeout(mainCtx, renderTimeout)
 		defer screenshotCancel()
 
 		devt := devtool.New("http://127.0.0.1:9222")
 
 		start := time.Now()
 
-		var target *devtool.Target
-		target, err = devt.Create(ctx)
+		var target *browserTarget
+		target, err = openTarget(ctx, devt)
 		if err != nil {
 			return
 		}
-		defer devt.Close(ctx, target)
 
 		log.Printf("[%s] Acquired a target %s", msgID, target.ID)
 
 		var conn *rpcc.Conn
 		conn, err = rpcc.DialContext(ctx, target.WebSocketDebuggerURL)
 		if err != nil {
+			target.close(ctx)
 			return
 		}
-		defer conn.Close()
 
 		// Take a screenshot using the library
 		client := cdp.NewClient(conn)
+		defer closeTarget(target, client, conn, msg.Geolocation != nil)
 
 		log.Printf("[%s] Entered the devtools of %s", msgID, target.ID)
 
-		result, err = screenshot.TakeScreenshot(
-			ctx, client, targetURL,
-			int(msg.Width), int(msg.Height), msg.Scaling,
-			time.Duration(msg.Delay)*time.Millisecond,
-			msg.FullPage, msg.Format, int(msg.Quality),
-		)
+		result, err = screenshot.Capture(ctx, client, &screenshot.Options{
+			URL:         targetURL,
+			HTML:        inlineHTML,
+			HTMLMode:    inlineMode,
+			BaseURL:     *htmlBaseURL,
+			Width:       int(msg.Width),
+			Height:      int(msg.Height),
+			Scaling:     msg.Scaling,
+			Delay:       time.Duration(msg.Delay) * time.Millisecond,
+			FullPage:    msg.FullPage,
+			LazyLoad:    msg.LazyLoading(),
+			Format:      msg.Format,
+			Quality:     int(msg.Quality),
+			AdBlocking:  msg.AdBlocking || *adBlocking,
+			Blocklist:   currentBlocklist(),
+			BlockedURLs: append(splitList(*blockedURLs), msg.BlockedURLs...),
+
+			NetworkPolicy:  policy,
+			Media:          msg.EmulatedMedia,
+			MediaFeatures:  msg.MediaFeatures,
+			Timezone:       msg.Timezone,
+			Locale:         msg.Locale,
+			Geolocation:    msg.Geolocation,
+			Conn:           conn,
+			BrowserContext: string(target.Context),
+			Steps:          msg.Steps,
+			Deterministic:  deterministic,
+			Dialogs:        msg.Dialogs,
+			Animation:      animation,
+			Viewports:      msg.Viewports,
+			Comparison:     comparison,
+			Fingerprint:    msg.Fingerprint,
+			SerializedDOM:  msg.SerializedDOM,
+			MHTML:          msg.MHTML,
+			HAR:            msg.HAR,
+			Performance:    msg.Performance,
+
+			MaxConsoleEntries: *consoleMaxEntries,
+			MaxConsoleLength:  *consoleMaxLength,
+			FailOnException:   msg.FailOnException,
+		})
 		if err != nil {
 			return
 		}
 
-		log.Printf("[%s] Screenshot of %s taken - elapsed %s", msgID, msg.URL, time.Now().Sub(start).String())
+		log.Printf("[%s] Screenshot of %s taken - elapsed %s, %d requests blocked", msgID, msg.URL, time.Now().Sub(start).String(), result.BlockedRequests)
+		if result.Console != nil {
+			log.Printf("[%s] The page logged %d messages, threw %d exceptions and failed %d requests", msgID,
+				len(result.Console.Messages), len(result.Console.Exceptions), len(result.Console.FailedRequests))
+		}
 	})
 	if err != nil {
-		return errors.Wrap(err, "failed to take a screenshot")
+		return nil, err
 	}
 
-	if msg.CallbackType == "" {
-		msg.CallbackType = "s3"
-	}
+	return result, nil
+}
 
-	var contentType string
-	if msg.Format == "png" {
-		contentType = "image/png"
-	} else {
-		contentType = "image/jpeg"
+// browserTarget is a page in a browser context of its own, so that the
+// permissions, cookies and storage of a job aren't shared with the others.
+type browserTarget struct {
+	*devtool.Target
+	Context target.BrowserContextID
+
+	devt    *devtool.DevTools
+	browser *rpcc.Conn
+}
+
+// openTarget creates a browser context and a blank page in it.
+func openTarget(ctx context.Context, devt *devtool.DevTools) (*browserTarget, error) {
+	browserURL, err := browserDebuggerURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	browser, err := rpcc.DialContext(ctx, browserURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to connect to the browser")
 	}
+	t := &browserTarget{devt: devt, browser: browser}
 
-	var code int
-	if msg.CallbackType == "s3" {
-		key := msgID + "." + msg.Format
+	client := cdp.NewClient(browser)
+	createdContext, err := client.Target.CreateBrowserContext(ctx)
+	if err != nil {
+		browser.Close()
+		return nil, errors.Wrap(err, "unable to create a browser context")
+	}
+	t.Context = createdContext.BrowserContextID
 
-		log.Printf("[%s] Starting upload to S3 at %s", msgID, key)
+	created, err := client.Target.CreateTarget(ctx, target.NewCreateTargetArgs("about:blank").SetBrowserContextID(t.Context))
+	if err != nil {
+		t.close(ctx)
+		return nil, errors.Wrap(err, "unable to create a target")
+	}
 
-		if _, err := s3Service.PutObject(
-			*s3Bucket,
-			key,
-			bytes.NewReader(result),
-			int64(len(result)),
-			minio.PutObjectOptions{
-				ContentType: contentType,
-			},
-		); err != nil {
-			return errors.Wrap(err, "unable to upload to s3")
+	targets, err := devt.List(ctx)
+	if err != nil {
+		t.close(ctx)
+		return nil, errors.Wrap(err, "unable to list the targets")
+	}
+	for _, candidate := range targets {
+		if candidate.ID == string(created.TargetID) {
+			t.Target = candidate
+			return t, nil
 		}
+	}
+	t.close(ctx)
+	return nil, errors.Errorf("the target %s is missing", created.TargetID)
+}
 
-		callbackContext, callbackCancel := context.WithTimeout(mainCtx, *callbackTimeout)
-		defer callbackCancel()
+// browserDebuggerURL returns the websocket url of the browser itself.
+func browserDebuggerURL(ctx context.Context) (string, error) {
+	req, err := http.NewRequest("GET", "http://127.0.0.1:9222/json/version", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrap(err, "unable to get the version of the browser")
+	}
+	defer resp.Body.Close()
 
-		req, err := http.NewRequest("POST", msg.Callback, strings.NewReader(*s3BasePath+"/"+key))
-		req.Header.Set("Content-Type", "text/plain")
-		resp, err := http.DefaultClient.Do(req.WithContext(callbackContext))
-		if err != nil {
-			return errors.Wrap(err, "unable to post the callback")
+	var version struct {
+		WebSocketDebuggerURL string `json:"webSocketDebuggerUrl"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&version); err != nil {
+		return "", errors.Wrap(err, "unable to decode the version of the browser")
+	}
+	if version.WebSocketDebuggerURL == "" {
+		return "", errors.New("the browser has no websocket url")
+	}
+	return version.WebSocketDebuggerURL, nil
+}
+
+// close disposes the browser context, closing the page in it, and the
+// connection to the browser.
+func (t *browserTarget) close(ctx context.Context) error {
+	defer t.browser.Close()
+	if t.Context == "" {
+		return nil
+	}
+	_, err := cdp.NewClient(t.browser).Target.DisposeBrowserContext(ctx, target.NewDisposeBrowserContextArgs(t.Context))
+	return errors.Wrap(err, "unable to dispose the browser context")
+}
+
+// closeTarget closes the target, its browser context and its connection. A
+// beforeunload dialog would keep the target open, so the dialogs are accepted
+// until the browser drops the connection. The permissions granted to the page
+// are reset when requested. It doesn't use the context of the job, which may
+// have already expired.
+func closeTarget(target *browserTarget, client *cdp.Client, conn *rpcc.Conn, resetPermissions bool) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	defer func() {
+		if err := target.close(ctx); err != nil {
+			log.Printf("Unable to close the browser context of %s: %v", target.ID, err)
 		}
-		resp.Body.Close()
-		code = resp.StatusCode
-	} else if msg.CallbackType == "blob" {
-		callbackContext, callbackCancel := context.WithTimeout(mainCtx, *callbackTimeout)
-		defer callbackCancel()
-
-		req, err := http.NewRequest("POST", msg.Callback, bytes.NewReader(result))
-		req.Header.Set("Content-Type", contentType)
-		resp, err := http.DefaultClient.Do(req.WithContext(callbackContext))
-		if err != nil {
-			return errors.Wrap(err, "unable to post the callback")
+	}()
+
+	if resetPermissions {
+		if err := screenshot.ResetPermissions(ctx, conn, string(target.Context)); err != nil {
+			log.Printf("Unable to reset the permissions granted to %s: %v", target.ID, err)
 		}
-		resp.Body.Close()
-		code = resp.StatusCode
-	} else {
-		return errors.Wrap(err, "invalid callback type")
 	}
 
-	log.Printf("[%s] Callback %s - %s done, code was %d.", msgID, msg.CallbackType, msg.Callback, code)
+	dialogs, err := screenshot.HandleDialogs(ctx, client, &screenshot.DialogPolicy{
+		Action: screenshot.DialogAccept,
+	})
+	if err != nil {
+		log.Printf("Unable to handle the dialogs of %s: %v", target.ID, err)
+		target.devt.Close(ctx, target.Target)
+		return
+	}
+	defer dialogs.Close()
 
-	return nil
+	if err := target.devt.Close(ctx, target.Target); err != nil {
+		log.Printf("Unable to close the target %s: %v", target.ID, err)
+		return
+	}
+
+	select {
+	case <-dialogs.Done():
+	case <-ctx.Done():
+		log.Printf("The target %s is still open after closing it", target.ID)
+	}
 }